@@ -0,0 +1,44 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "atomicfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "file")
+	for _, data := range []string{"old", "new contents"} {
+		err = WriteFile(path, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != data {
+			t.Errorf("read %#v; expected %#v", string(written), data)
+		}
+	}
+	// the temporary files were renamed
+	infos, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Errorf("expected one file: %d", len(infos))
+	}
+
+	err = WriteFile(filepath.Join(tempDir, "does_not_exist", "file"), []byte("data"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected does not exist: %v", err)
+	}
+}
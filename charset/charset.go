@@ -0,0 +1,163 @@
+// Package charset detects the encoding of text files and converts them to UTF-8
+package charset
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings returned by Detect. UTF-8 without a byte order mark is the empty string.
+const (
+	UTF8        = ""
+	UTF8BOM     = "utf-8-bom"
+	UTF16LE     = "utf-16le"
+	UTF16BE     = "utf-16be"
+	Windows1252 = "windows-1252"
+)
+
+// Number of bytes Sniff needs to detect UTF-16 without a byte order mark.
+const SniffLen = 4096
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// Sniff detects the encodings that can be recognized from the start of a file: a byte order
+// mark, or UTF-16 where every other byte of the first SniffLen bytes is zero. Otherwise it
+// returns UTF8; use Detect to check the rest of the file.
+func Sniff(prefix []byte) string {
+	if bytes.HasPrefix(prefix, utf8BOM) {
+		return UTF8BOM
+	}
+	if len(prefix) >= 2 {
+		if prefix[0] == 0xff && prefix[1] == 0xfe {
+			return UTF16LE
+		}
+		if prefix[0] == 0xfe && prefix[1] == 0xff {
+			return UTF16BE
+		}
+	}
+
+	// mostly ASCII text in UTF-16 has zeros as the high bytes
+	if len(prefix) > SniffLen {
+		prefix = prefix[:SniffLen]
+	}
+	prefix = prefix[:len(prefix)&^1]
+	if len(prefix) == 0 {
+		return UTF8
+	}
+	zeros := [2]int{}
+	for i, b := range prefix {
+		if b == 0 {
+			zeros[i&1]++
+		}
+	}
+	pairs := len(prefix) / 2
+	if zeros[0] == 0 && zeros[1]*2 >= pairs {
+		return UTF16LE
+	}
+	if zeros[1] == 0 && zeros[0]*2 >= pairs {
+		return UTF16BE
+	}
+	return UTF8
+}
+
+// Detect returns the encoding of data, or an error if it does not look like text. Text that
+// is not valid UTF-8 is assumed to be Windows-1252, a superset of Latin-1, unless it contains
+// control characters other than white space.
+func Detect(data []byte) (string, error) {
+	encoding := Sniff(data)
+	if encoding != UTF8 || utf8.Valid(data) {
+		return encoding, nil
+	}
+	if i := controlIndex(data); i >= 0 {
+		return "", fmt.Errorf("charset: control character 0x%02x: not text", data[i])
+	}
+	return Windows1252, nil
+}
+
+// HasControl reports whether data contains control characters other than white space. Detect
+// rejects data that has them unless it is valid UTF-8 or UTF-16, so a prefix is enough to
+// reject a file without reading all of it.
+func HasControl(data []byte) bool {
+	return controlIndex(data) >= 0
+}
+
+// controlIndex returns the index of the first control character in data that is not white
+// space, or -1 if there is none.
+func controlIndex(data []byte) int {
+	for i, b := range data {
+		if b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != '\f' || b == 0x7f {
+			return i
+		}
+	}
+	return -1
+}
+
+// Decode converts data in encoding to UTF-8. UTF-8 data is returned unchanged, except for
+// removing a byte order mark.
+func Decode(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case UTF8:
+		return data, nil
+	case UTF8BOM:
+		return bytes.TrimPrefix(data, utf8BOM), nil
+	case UTF16LE, UTF16BE:
+		return decodeUTF16(data, encoding == UTF16BE), nil
+	case Windows1252:
+		return decodeWindows1252(data), nil
+	}
+	return nil, fmt.Errorf("charset: unsupported encoding %#v", encoding)
+}
+
+func decodeUTF16(data []byte, bigEndian bool) []byte {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	if len(units) > 0 && units[0] == 0xfeff {
+		units = units[1:]
+	}
+	out := make([]byte, 0, len(units))
+	var buf [utf8.UTFMax]byte
+	for _, r := range utf16.Decode(units) {
+		n := utf8.EncodeRune(buf[:], r)
+		out = append(out, buf[:n]...)
+	}
+	if len(data)&1 != 0 {
+		// odd trailing byte
+		out = append(out, string(utf8.RuneError)...)
+	}
+	return out
+}
+
+// Windows-1252 characters 0x80-0x9f. The 5 unused bytes map to the C1 control characters,
+// like web browsers.
+var windows1252 = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008d', 'Ž', '\u008f',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009d', 'ž', 'Ÿ',
+}
+
+func decodeWindows1252(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	var buf [utf8.UTFMax]byte
+	for _, b := range data {
+		if b < utf8.RuneSelf {
+			out = append(out, b)
+			continue
+		}
+		r := rune(b)
+		if b < 0xa0 {
+			r = windows1252[b-0x80]
+		}
+		n := utf8.EncodeRune(buf[:], r)
+		out = append(out, buf[:n]...)
+	}
+	return out
+}
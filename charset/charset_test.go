@@ -0,0 +1,77 @@
+package charset
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectAndDecode(t *testing.T) {
+	tests := []struct {
+		data     string
+		encoding string
+		decoded  string
+	}{
+		{"", UTF8, ""},
+		{"hello\n", UTF8, "hello\n"},
+		{"caf\xc3\xa9\n", UTF8, "café\n"},
+		{"\xef\xbb\xbfhello", UTF8BOM, "hello"},
+		{"\xff\xfeh\x00\xe9\x00", UTF16LE, "hé"},
+		{"\xfe\xff\x00h\x00\xe9", UTF16BE, "hé"},
+		{"h\x00i\x00\n\x00", UTF16LE, "hi\n"},
+		{"\x00h\x00i\x00\n", UTF16BE, "hi\n"},
+		// surrogate pair
+		{"\xff\xfe\x3d\xd8\x00\xde", UTF16LE, "\U0001f600"},
+		// odd length
+		{"\xff\xfeh\x00i", UTF16LE, "h�"},
+		{"caf\xe9\n", Windows1252, "café\n"},
+		{"\x93quoted\x94 \x80 \x81", Windows1252, "“quoted” € \u0081"},
+		{"tab\tand\r\nform\ffeed\xa0", Windows1252, "tab\tand\r\nform\ffeed "},
+	}
+	for i, test := range tests {
+		encoding, err := Detect([]byte(test.data))
+		if err != nil {
+			t.Errorf("%d: Detect(%#v) error: %s", i, test.data, err.Error())
+			continue
+		}
+		if encoding != test.encoding {
+			t.Errorf("%d: Detect(%#v)=%#v; expected %#v", i, test.data, encoding, test.encoding)
+		}
+		decoded, err := Decode([]byte(test.data), test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(decoded) != test.decoded {
+			t.Errorf("%d: Decode(%#v)=%#v; expected %#v", i, test.data, string(decoded), test.decoded)
+		}
+	}
+}
+
+func TestDetectBinary(t *testing.T) {
+	for _, data := range []string{"\x7fELF\x02\x01\x01\x00\xff", "text\n\x01\xff", "\xe9\x00\x00\x00\x00"} {
+		encoding, err := Detect([]byte(data))
+		if err == nil {
+			t.Errorf("Detect(%#v)=%#v; expected an error", data, encoding)
+		}
+		if !HasControl([]byte(data)) {
+			t.Errorf("HasControl(%#v)=false", data)
+		}
+	}
+	if HasControl([]byte("caf\xe9\tand\r\n\f")) {
+		t.Error("HasControl should ignore white space")
+	}
+}
+
+func TestSniffLength(t *testing.T) {
+	// only the first SniffLen bytes are checked
+	data := strings.Repeat("a\x00", SniffLen/2) + "\x00\x00"
+	if Sniff([]byte(data)) != UTF16LE {
+		t.Errorf("Sniff should ignore bytes after SniffLen")
+	}
+	if Sniff([]byte("a\x00b\x00\x00c")) != UTF8 {
+		t.Errorf("Sniff should require one zero byte in every other position")
+	}
+	_, err := Decode([]byte("x"), "ebcdic")
+	if err == nil {
+		t.Errorf("Decode should fail for unsupported encodings")
+	}
+}
@@ -0,0 +1,258 @@
+// Command cs searches an index created by csearch from the command line. It accepts the same
+// queries as the web UI, and prints grep-style output for scripts and editors.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/evanj/csearch/reindex"
+)
+
+// ANSI colors, the same as GNU grep
+const (
+	colorPath      = "35"
+	colorNumber    = "32"
+	colorSeparator = "36"
+	colorMatch     = "1;31"
+)
+
+// exit codes, the same as grep
+const (
+	exitMatch   = 0
+	exitNoMatch = 1
+	exitError   = 2
+)
+
+type jsonMatch struct {
+	Path       string `json:"path"`
+	LineNumber int    `json:"line_number"`
+	Column     int    `json:"column"`
+	Line       string `json:"line"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Lang       string `json:"lang"`
+}
+
+type jsonFile struct {
+	Path  string `json:"path"`
+	Count int    `json:"count,omitempty"`
+}
+
+type printer struct {
+	w           io.Writer
+	color       bool
+	lineNumbers bool
+}
+
+func (p *printer) colored(color string, s string) string {
+	if !p.color || s == "" {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+func (p *printer) separator() string {
+	return p.colored(colorSeparator, ":")
+}
+
+// printMatch prints path:text, or path:line:col: text with line numbers. Columns are bytes,
+// starting at 1, like compiler errors.
+func (p *printer) printMatch(r *reindex.Result) {
+	line := r.Line[:r.Start] + p.colored(colorMatch, r.Line[r.Start:r.End]) + r.Line[r.End:]
+	if p.lineNumbers {
+		fmt.Fprintf(p.w, "%s%s%s%s%s%s %s\n", p.colored(colorPath, r.Path), p.separator(),
+			p.colored(colorNumber, fmt.Sprint(r.LineNumber)), p.separator(),
+			p.colored(colorNumber, fmt.Sprint(r.Start+1)), p.separator(), line)
+	} else {
+		fmt.Fprintf(p.w, "%s%s%s\n", p.colored(colorPath, r.Path), p.separator(), line)
+	}
+}
+
+// printSkipped prints path: reason for each file that was not indexed, with the line number
+// when the reason applies to one line.
+func (p *printer) printSkipped(s reindex.Skipped) {
+	reason := s.Reason
+	if s.Line > 0 {
+		reason += fmt.Sprintf(" (line %d)", s.Line)
+	}
+	if s.Error != "" {
+		reason += ": " + s.Error
+	}
+	fmt.Fprintf(p.w, "%s%s %s\n", p.colored(colorPath, s.Path), p.separator(), reason)
+}
+
+// Returns the paths with matches in the order they were first found, and the number of
+// matching lines in each.
+func countFiles(results []*reindex.Result) ([]string, map[string]int) {
+	var paths []string
+	counts := map[string]int{}
+	for _, r := range results {
+		if counts[r.Path] == 0 {
+			paths = append(paths, r.Path)
+		}
+		counts[r.Path] += 1
+	}
+	return paths, counts
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: cs [flags] (query)\n       cs -skipped [-json]\n       cs -check\n\n")
+	fmt.Fprintf(os.Stderr, "The query is the same as the csearch web UI: lang:, dir:, ext: and root: filters,\n")
+	fmt.Fprintf(os.Stderr, "then sym:(name), ident:[kind:](name) or a regexp.\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	indexPath := flag.String("index", "csearch_index", "Path to the index created by csearch")
+	fileRegexp := flag.String("f", "", "Only search files with paths that match this regexp")
+	listFiles := flag.Bool("l", false, "Only print the paths of files with matches")
+	countLines := flag.Bool("c", false, "Only print the number of matching lines in each file")
+	lineNumbers := flag.Bool("n", false, "Print line and column numbers: path:line:col: text")
+	jsonOutput := flag.Bool("json", false, "Print one JSON object per match, or per file with -l or -c")
+	color := flag.String("color", "auto", "Color the output: auto (if stdout is a terminal), always or never")
+	verbose := flag.Bool("verbose", false, "Log the query timing to stderr")
+	listSkipped := flag.Bool("skipped", false, "Print the files that were not indexed and why, instead of searching")
+	check := flag.Bool("check", false, "Check the whole index for corruption, instead of searching")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 && !*listSkipped && !*check {
+		usage()
+		os.Exit(exitError)
+	}
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	useColor := false
+	switch *color {
+	case "always":
+		useColor = true
+	case "auto":
+		useColor = isTerminal(os.Stdout)
+	case "never":
+	default:
+		fmt.Fprintf(os.Stderr, "cs: invalid -color: %s\n", *color)
+		os.Exit(exitError)
+	}
+
+	// sharded indexes only have the list of shards at indexPath.shards
+	if _, err := os.Stat(*indexPath); err != nil && !exists(reindex.ShardsPath(*indexPath)) {
+		fmt.Fprintf(os.Stderr, "cs: %s (run csearch to create the index)\n", err.Error())
+		os.Exit(exitError)
+	}
+	ix, err := reindex.OpenSharded(*indexPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cs: %s\n", err.Error())
+		os.Exit(exitError)
+	}
+
+	if *check {
+		err = ix.Verify()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cs: %s\n", err.Error())
+			os.Exit(exitError)
+		}
+		for i, shard := range ix.Shards() {
+			checksums := "checksums ok"
+			if !shard.HasChecksums() {
+				checksums = "no checksums"
+			}
+			fmt.Printf("%s: ok: version %d, %d files, %s\n",
+				ix.ShardPaths()[i], shard.Version(), shard.NumNames(), checksums)
+		}
+		os.Exit(exitMatch)
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(w)
+	p := &printer{w, useColor && !*jsonOutput, *lineNumbers}
+	if *listSkipped {
+		for _, s := range ix.Skipped() {
+			if *jsonOutput {
+				err = encoder.Encode(s)
+				if err != nil {
+					break
+				}
+			} else {
+				p.printSkipped(s)
+			}
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cs: %s\n", err.Error())
+			os.Exit(exitError)
+		}
+		os.Exit(exitMatch)
+	}
+
+	// several arguments are joined like the search box: cs lang:go TODO
+	q := strings.Join(flag.Args(), " ")
+	_, _, results, err := reindex.SearchQuery(ix, ix.Symbols(), q, *fileRegexp, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cs: %s\n", err.Error())
+		os.Exit(exitError)
+	}
+
+	if *listFiles || *countLines {
+		paths, counts := countFiles(results)
+		for _, path := range paths {
+			count := 0
+			if *countLines {
+				count = counts[path]
+			}
+			if *jsonOutput {
+				err = encoder.Encode(jsonFile{path, count})
+			} else if *countLines {
+				_, err = fmt.Fprintf(w, "%s%s%d\n", p.colored(colorPath, path), p.separator(), count)
+			} else {
+				_, err = fmt.Fprintln(w, p.colored(colorPath, path))
+			}
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		for _, r := range results {
+			if *jsonOutput {
+				err = encoder.Encode(jsonMatch{r.Path, r.LineNumber, r.Start + 1, r.Line, r.Start, r.End, r.Lang})
+				if err != nil {
+					break
+				}
+			} else {
+				p.printMatch(r)
+			}
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cs: %s\n", err.Error())
+		os.Exit(exitError)
+	}
+
+	if len(results) == 0 {
+		os.Exit(exitNoMatch)
+	}
+	os.Exit(exitMatch)
+}
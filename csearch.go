@@ -1,39 +1,88 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/evanj/csearch/grep"
+	"github.com/evanj/csearch/history"
 	"github.com/evanj/csearch/reindex"
-	"github.com/google/codesearch/index"
+	"github.com/evanj/csearch/symbol"
 )
 
 const indexPath = "csearch_index"
+const historyPath = "csearch_history.json"
+const frecencyPath = "csearch_frecency.json"
+
+// Maximum typeahead score boost for files that are opened often: more than a fuzzy file name
+// match, less than a file name prefix match
+const maxFrecencyBoost = 200
 const staticPath = "static"
 
 const maxFileMatches = 200
+const maxSymbolMatches = 200
+
+// The index and the structures built from it, which are replaced together by a reindex.
+type searchIndex struct {
+	ix          *reindex.ShardedIndex
+	fileMatcher *grep.ShardedMatcher
+	symbols     *symbol.Table
+}
+
+type reindexStatus struct {
+	Running bool
+	Start   time.Time
+	// of the running reindex; nil until it is first reported
+	Progress *reindex.Progress
+	// of the last reindex that finished
+	Duration time.Duration
+	Err      string
+}
 
 type csearchServer struct {
-	ix          *index.Index
-	fileMatcher *grep.IndexedMatcher
+	// held for reading while using index, and for writing to replace it
+	mu      sync.RWMutex
+	index   *searchIndex
+	history *history.Store
+	// nil if disabled
+	frecency    *history.Frecency
 	stripPrefix string
+	// rebuilds the index from the source trees, calling progress while adding files
+	build func(progress func(reindex.Progress)) (*searchIndex, error)
+
+	reindexMu     sync.Mutex
+	reindexStatus reindexStatus
+}
+
+// acquireIndex returns the current index, which is not closed until releaseIndex is called.
+func (server *csearchServer) acquireIndex() *searchIndex {
+	server.mu.RLock()
+	return server.index
+}
+
+func (server *csearchServer) releaseIndex() {
+	server.mu.RUnlock()
 }
 
-const formPage = `<html>
+const formTemplateString = `<html>
 <head><title>codesearch</title>
 <script>
-var attachTypeahead = function() {
-	var typeaheadInput = document.getElementById('typeahead_in');
-	var typeaheadOutput = document.getElementById('typeahead_out')
+var attachTypeahead = function(inputId, outputId, path) {
+	var typeaheadInput = document.getElementById(inputId);
+	var typeaheadOutput = document.getElementById(outputId);
 	var generation = 0;
 
 	var typeaheadError = function(e) {
@@ -58,7 +107,7 @@ var attachTypeahead = function() {
 
 			typeaheadOutput.innerHTML = result;
 		}
-		ajax('/type?q=' + typeaheadInput.value, typeaheadSuccess, typeaheadError);
+		ajax(path + '?q=' + encodeURIComponent(typeaheadInput.value), typeaheadSuccess, typeaheadError);
 	}
 	typeaheadInput.addEventListener('input', onInput);
 }
@@ -79,7 +128,19 @@ var ajax = function(path, onSuccess, onError) {
 	request.send();
 }
 
-window.addEventListener('load', attachTypeahead);
+var deleteSaved = function(name) {
+	var request = new XMLHttpRequest();
+	request.open('DELETE', '/api/saved?name=' + encodeURIComponent(name), true);
+	request.onload = function() {
+		window.location.reload();
+	};
+	request.send();
+}
+
+window.addEventListener('load', function() {
+	attachTypeahead('typeahead_in', 'typeahead_out', '/type');
+	attachTypeahead('symbols_in', 'symbols_out', '/symbols');
+});
 </script>
 </head>
 <body>
@@ -91,13 +152,65 @@ Query: <input type="text" name="q" autofocus> file filter: <input type="text" na
 File name live: <input id="typeahead_in" type="text" name="q" width="50">
 <div id="typeahead_out"></div>
 </form>
+
+<form>
+Symbol live: <input id="symbols_in" type="text" name="q" width="50">
+<div id="symbols_out"></div>
+</form>
+
+<p><a href="/status">Index status</a></p>
+
+{{if .Saved}}<h3>Saved searches</h3>
+<ul>
+{{range .Saved}}<li><a href="{{.URL}}">{{.Name}}</a>: <code>{{.Query.Query}}</code>{{if .FileFilter}} in <code>{{.FileFilter}}</code>{{end}} <button onclick="deleteSaved('{{.Name}}')">delete</button></li>
+{{end}}</ul>{{end}}
+
+{{if .Recent}}<h3>Recent searches</h3>
+<ul>
+{{range .Recent}}<li><a href="{{.URL}}"><code>{{.Query.Query}}</code></a>{{if .FileFilter}} in <code>{{.FileFilter}}</code>{{end}}</li>
+{{end}}</ul>{{end}}
 </body></html>`
 
+var formTemplate = template.Must(template.New("form").Parse(formTemplateString))
+
+type savedLink struct {
+	history.Saved
+	URL string
+}
+
+type recentLink struct {
+	history.Recent
+	URL string
+}
+
+type formPage struct {
+	Saved  []savedLink
+	Recent []recentLink
+}
+
 type formattedResult struct {
-	*grep.Match
+	*reindex.Result
 	TruncatedPath string
 }
 
+type facetLink struct {
+	Label string
+	Files int
+	URL   string
+}
+
+type facetGroup struct {
+	Name  string
+	Links []facetLink
+}
+
+type resultsPage struct {
+	Query      string
+	FileFilter string
+	Results    []*formattedResult
+	Facets     []facetGroup
+}
+
 func (f *formattedResult) HTMLLine() template.HTML {
 	beforeMatch := template.HTMLEscapeString(f.Line[:f.Start])
 	matched := template.HTMLEscapeString(f.Line[f.Start:f.End])
@@ -117,26 +230,230 @@ const resultsTemplateString = `<html>
 .m {
   font-weight: bold;
 }
+
+.lang {
+  font-size: small;
+  background-color: #eee;
+  border-radius: 3px;
+  padding: 0 3px;
+}
 </style>
 </head>
 <body>
 
+<form action="/search" method="GET">
+Query: <input type="text" name="q" value="{{.Query}}"> file filter: <input type="text" name="f" value="{{.FileFilter}}"> <input type="submit" value="Search">
+</form>
+
+<form action="/save" method="POST">
+<input type="hidden" name="q" value="{{.Query}}"><input type="hidden" name="f" value="{{.FileFilter}}">
+Save this search as: <input type="text" name="name"> <input type="submit" value="Save">
+</form>
+
+{{if .Results}}{{range .Facets}}<p>{{.Name}}: {{range .Links}}<a href="{{.URL}}">{{.Label}}</a> ({{.Files}}) {{end}}</p>
+{{end}}{{end}}
 <table>
-{{range .}}
-<tr><td><a href="/open?path={{.Path}}&linenum={{.LineNumber}}">{{.TruncatedPath}}:{{.LineNumber}}</a></td><td class="results"><code>{{.HTMLLine}}</code></td></tr>
+{{range .Results}}
+<tr><td><a href="/open?path={{.Path}}&linenum={{.LineNumber}}">{{.TruncatedPath}}:{{.LineNumber}}</a>{{if .Lang}} <span class="lang">{{.Lang}}</span>{{end}}</td><td class="results"><code>{{.HTMLLine}}</code></td></tr>
 {{end}}
 </table>
 </body></html>`
 
 var resultsTemplate = template.Must(template.New("results").Parse(resultsTemplateString))
 
+var symbolTemplate = template.Must(template.New("symbol").Parse(
+	`<div>{{.Kind}} <a href="/open?path={{.Path}}&linenum={{.LineNumber}}">{{.QualifiedName}}</a> {{.TruncatedPath}}:{{.LineNumber}}</div>`))
+
+const statusTemplateString = `<html>
+<head><title>codesearch status</title>
+{{if .Reindex.Running}}<meta http-equiv="refresh" content="2">{{end}}</head>
+<body>
+<h3>Index</h3>
+<p>{{.Files}} files indexed in:</p>
+<ul>
+{{range .Roots}}<li><code>{{.}}</code></li>
+{{end}}</ul>
+{{if gt .Shards 1}}<p>The index has {{.Shards}} shards, which are searched in parallel.</p>
+{{end}}{{with .Reindex}}{{if .Running}}<p>Reindexing since {{.Start.Format "15:04:05"}}: searches use the previous index until it is done.</p>
+{{with .Progress}}<p>{{.}}</p>
+{{end}}{{else}}{{if .Err}}<p>Reindex failed: {{.Err}}</p>
+{{else if .Duration}}<p>Reindexed at {{.Start.Format "15:04:05"}} in {{.Duration}}</p>
+{{end}}<form action="/reindex" method="POST"><input type="submit" value="Reindex"></form>
+{{end}}{{end}}
+<h3>Skipped files</h3>
+{{if .Skipped}}<p>{{range .Reasons}}{{.Reason}}: {{.Files}} {{end}}</p>
+<table>
+{{range .Skipped}}<tr><td><a href="/open?path={{.Path}}&linenum={{if .Line}}{{.Line}}{{else}}1{{end}}">{{.TruncatedPath}}</a></td><td>{{.Reason}}{{if .Line}} (line {{.Line}}){{end}}{{if .Error}}: {{.Error}}{{end}}</td></tr>
+{{end}}</table>{{else}}<p>None</p>{{end}}
+</body></html>`
+
+var statusTemplate = template.Must(template.New("status").Parse(statusTemplateString))
+
+type skipReasonCount struct {
+	Reason string
+	Files  int
+}
+
+type skippedFile struct {
+	reindex.Skipped
+	TruncatedPath string
+}
+
+type statusPage struct {
+	Files   int
+	Shards  int
+	Roots   []string
+	Reindex reindexStatus
+	Reasons []skipReasonCount
+	Skipped []skippedFile
+}
+
+func (server *csearchServer) statusHandler(w http.ResponseWriter, r *http.Request) {
+	index := server.acquireIndex()
+	defer server.releaseIndex()
+
+	page := &statusPage{Files: index.ix.NumNames(), Shards: len(index.ix.Shards()), Roots: index.ix.Paths()}
+	server.reindexMu.Lock()
+	page.Reindex = server.reindexStatus
+	server.reindexMu.Unlock()
+	counts := map[string]int{}
+	for _, s := range index.ix.Skipped() {
+		if counts[s.Reason] == 0 {
+			page.Reasons = append(page.Reasons, skipReasonCount{Reason: s.Reason})
+		}
+		counts[s.Reason] += 1
+		page.Skipped = append(page.Skipped, skippedFile{s, server.trimPath(s.Path)})
+	}
+	for i := range page.Reasons {
+		page.Reasons[i].Files = counts[page.Reasons[i].Reason]
+	}
+	sort.SliceStable(page.Reasons, func(i, j int) bool {
+		return page.Reasons[i].Files > page.Reasons[j].Files
+	})
+	err := statusTemplate.Execute(w, page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Starts rebuilding the index in the background, unless it is already running.
+func (server *csearchServer) reindexHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "reindex requires POST", http.StatusMethodNotAllowed)
+		return
+	}
+	server.reindexMu.Lock()
+	running := server.reindexStatus.Running
+	if !running {
+		server.reindexStatus = reindexStatus{Running: true, Start: time.Now()}
+	}
+	server.reindexMu.Unlock()
+	if !running {
+		go server.reindex()
+	}
+	http.Redirect(w, r, "/status", http.StatusSeeOther)
+}
+
+// Builds a new index and replaces the current one once it is complete. Searches keep using the
+// old index, which stays mapped after the new one is renamed over it, until then.
+func (server *csearchServer) reindex() {
+	start := time.Now()
+	index, err := server.build(func(p reindex.Progress) {
+		server.reindexMu.Lock()
+		server.reindexStatus.Progress = &p
+		server.reindexMu.Unlock()
+	})
+	if err == nil {
+		server.mu.Lock()
+		old := server.index
+		server.index = index
+		server.mu.Unlock()
+		closeErr := old.ix.Close()
+		if closeErr != nil {
+			log.Printf("failed to close the old index: %s", closeErr)
+		}
+	} else {
+		log.Printf("reindex failed: %s", err)
+	}
+
+	server.reindexMu.Lock()
+	defer server.reindexMu.Unlock()
+	server.reindexStatus.Running = false
+	server.reindexStatus.Duration = time.Since(start)
+	if err != nil {
+		server.reindexStatus.Err = err.Error()
+	}
+}
+
 func (server *csearchServer) handler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
 		return
 	}
 
-	w.Write([]byte(formPage))
+	page := &formPage{}
+	for _, saved := range server.history.Saved() {
+		page.Saved = append(page.Saved, savedLink{saved, searchURL(saved.Query.Query, saved.FileFilter)})
+	}
+	for _, recent := range server.history.Recent() {
+		page.Recent = append(page.Recent, recentLink{recent, searchURL(recent.Query.Query, recent.FileFilter)})
+	}
+	err := formTemplate.Execute(w, page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns s as HTML with the runes at positions in bold. positions must be sorted.
+func highlightPositions(s string, positions []int) template.HTML {
+	var out bytes.Buffer
+	runeIndex := 0
+	bold := false
+	for _, r := range s {
+		matched := len(positions) > 0 && positions[0] == runeIndex
+		if matched {
+			positions = positions[1:]
+		}
+		if matched != bold {
+			if matched {
+				out.WriteString("<b>")
+			} else {
+				out.WriteString("</b>")
+			}
+			bold = matched
+		}
+		template.HTMLEscape(&out, []byte(string(r)))
+		runeIndex += 1
+	}
+	if bold {
+		out.WriteString("</b>")
+	}
+	return template.HTML(out.String())
+}
+
+// Returns the limit form parameter, or defaultLimit if it is not set.
+func parseLimit(r *http.Request, defaultLimit int) (int, error) {
+	limitString := r.Form.Get("limit")
+	if limitString == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(limitString)
+	if err != nil {
+		return 0, err
+	}
+	if limit <= 0 {
+		return 0, errors.New("limit must be positive: " + limitString)
+	}
+	return limit, nil
+}
+
+// matchFiles returns the file name matches for the typeahead.
+func (server *csearchServer) matchFiles(index *searchIndex, q string, limit int) *grep.FuzzyMatcher {
+	var boosts map[string]int
+	if server.frecency != nil {
+		boosts = server.frecency.Boosts(time.Now(), maxFrecencyBoost)
+	}
+	return index.fileMatcher.MatchResults(q, limit, boosts)
 }
 
 func (server *csearchServer) typeaheadHandler(w http.ResponseWriter, r *http.Request) {
@@ -150,17 +467,78 @@ func (server *csearchServer) typeaheadHandler(w http.ResponseWriter, r *http.Req
 		// 200 OK: Empty body (no results)
 		return
 	}
+	limit, err := parseLimit(r, maxFileMatches)
+	if err != nil {
+		panic(err)
+	}
+	index := server.acquireIndex()
+	defer server.releaseIndex()
 
 	// search for matching files!
-	results := server.fileMatcher.Match(q, maxFileMatches)
-	for _, path := range results {
-		w.Write([]byte("<div>"))
-		template.HTMLEscape(w, []byte(path))
-		w.Write([]byte("</div>"))
+	results := server.matchFiles(index, q, limit).ResultsWithPositions()
+	for _, result := range results {
+		openURL := "/open?path=" + url.QueryEscape(result.Path) + "&linenum=1"
+		w.Write([]byte("<div><a href=\"" + template.HTMLEscapeString(openURL) + "\">"))
+		w.Write([]byte(highlightPositions(result.Path, result.Positions)))
+		w.Write([]byte("</a></div>"))
 	}
 	end := time.Now()
 	log.Printf("typeahead query len: %d; paths: %d; limited matches: %d; %f seconds",
-		len(q), server.ix.NumNames(), len(results), end.Sub(start).Seconds())
+		len(q), index.ix.NumNames(), len(results), end.Sub(start).Seconds())
+}
+
+type jsonFileMatch struct {
+	Path  string `json:"path"`
+	Score int    `json:"score"`
+	// Indexes of the runes (not bytes) in Path that matched the query
+	Positions []int `json:"positions"`
+	Typo      bool  `json:"typo"`
+}
+
+type jsonTypeaheadResponse struct {
+	Results      []jsonFileMatch `json:"results"`
+	TotalMatches int             `json:"total_matches"`
+}
+
+func (server *csearchServer) apiTypeaheadHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseLimit(r, maxFileMatches)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	index := server.acquireIndex()
+	defer server.releaseIndex()
+
+	response := jsonTypeaheadResponse{Results: []jsonFileMatch{}}
+	if q := r.Form.Get("q"); q != "" {
+		matches := server.matchFiles(index, q, limit)
+		for _, result := range matches.ResultsWithPositions() {
+			response.Results = append(response.Results,
+				jsonFileMatch{result.Path, result.Score, result.Positions, result.Typo})
+		}
+		response.TotalMatches = matches.TotalMatches()
+	}
+	writeJSON(w, response)
+}
+
+// Runs the query q, which may start with filter terms, in files matching fileRegexp.
+func (server *csearchServer) search(index *searchIndex, q string, fileRegexp string) (
+	string, reindex.Filter, []*reindex.Result, error) {
+
+	return reindex.SearchQuery(index.ix, index.symbols, q, fileRegexp, maxSymbolMatches)
+}
+
+func (server *csearchServer) trimPath(path string) string {
+	if strings.HasPrefix(path, server.stripPrefix) {
+		return path[len(server.stripPrefix):]
+	}
+	return path
 }
 
 func (server *csearchServer) searchHandler(w http.ResponseWriter, r *http.Request) {
@@ -168,23 +546,125 @@ func (server *csearchServer) searchHandler(w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		panic(err)
 	}
-	results, err := reindex.Search(server.ix, r.Form.Get("q"), r.Form.Get("f"))
+	q := r.Form.Get("q")
+	index := server.acquireIndex()
+	defer server.releaseIndex()
+	pattern, filter, results, err := server.search(index, q, r.Form.Get("f"))
 	if err != nil {
 		panic(err)
 	}
+	server.history.AddRecent(history.Query{Query: q, FileFilter: filter.File}, time.Now())
 
-	formattedResults := make([]*formattedResult, len(results))
+	page := &resultsPage{Query: q, FileFilter: filter.File}
+	page.Results = make([]*formattedResult, len(results))
 	for i, r := range results {
-		formattedPath := r.Path
-		if strings.HasPrefix(formattedPath, server.stripPrefix) {
-			formattedPath = formattedPath[len(server.stripPrefix):]
+		page.Results[i] = &formattedResult{r, server.trimPath(r.Path)}
+	}
+
+	facets := reindex.CountFacets(index.ix, results)
+	addGroup := func(name string, counts []reindex.FacetCount, values *[]string, label func(string) string) {
+		// narrow the current filter to each value in turn
+		original := *values
+		group := facetGroup{Name: name}
+		for _, count := range counts {
+			*values = []string{count.Value}
+			link := facetLink{label(count.Value), count.Files, searchURL(reindex.FormatQuery(pattern, filter), filter.File)}
+			group.Links = append(group.Links, link)
+		}
+		*values = original
+		page.Facets = append(page.Facets, group)
+	}
+	orNone := func(none string) func(string) string {
+		return func(value string) string {
+			if value == "" {
+				return none
+			}
+			return value
 		}
-		formattedResults[i] = &formattedResult{r, formattedPath}
 	}
-	err = resultsTemplate.Execute(w, formattedResults)
+	addGroup("Languages", facets.Langs, &filter.Langs, orNone("(unknown)"))
+	addGroup("Directories", facets.Dirs, &filter.Dirs, orNone("(top level)"))
+	addGroup("Extensions", facets.Exts, &filter.Exts, orNone("(none)"))
+	addGroup("Roots", facets.Roots, &filter.Roots, server.trimPath)
+
+	err = resultsTemplate.Execute(w, page)
+	if err != nil {
+		panic(err)
+	}
+}
+
+type jsonResult struct {
+	Path       string `json:"path"`
+	LineNumber int    `json:"line_number"`
+	Line       string `json:"line"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Lang       string `json:"lang"`
+}
+
+type jsonSearchResponse struct {
+	Results []jsonResult    `json:"results"`
+	Facets  *reindex.Facets `json:"facets"`
+}
+
+// Returns search results and facets as JSON. Takes the same parameters as /search.
+func (server *csearchServer) apiSearchHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	index := server.acquireIndex()
+	defer server.releaseIndex()
+	_, _, results, err := server.search(index, r.Form.Get("q"), r.Form.Get("f"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := jsonSearchResponse{make([]jsonResult, len(results)), reindex.CountFacets(index.ix, results)}
+	for i, r := range results {
+		response.Results[i] = jsonResult{r.Path, r.LineNumber, r.Line, r.Start, r.End, r.Lang}
+	}
+	writeJSON(w, response)
+}
+
+func searchURL(q string, fileFilter string) string {
+	values := url.Values{}
+	values.Set("q", q)
+	if fileFilter != "" {
+		values.Set("f", fileFilter)
+	}
+	return "/search?" + values.Encode()
+}
+
+func (server *csearchServer) symbolsHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	err := r.ParseForm()
 	if err != nil {
 		panic(err)
 	}
+	q := r.Form.Get("q")
+	if q == "" {
+		// 200 OK: Empty body (no results)
+		return
+	}
+
+	index := server.acquireIndex()
+	defer server.releaseIndex()
+	results := index.symbols.Match(q, maxSymbolMatches)
+	for _, s := range results {
+		err = symbolTemplate.Execute(w, struct {
+			*symbol.Symbol
+			TruncatedPath string
+		}{s, server.trimPath(s.Path)})
+		if err != nil {
+			panic(err)
+		}
+	}
+	end := time.Now()
+	log.Printf("symbols query len: %d; symbols: %d; limited matches: %d; %f seconds",
+		len(q), index.symbols.Len(), len(results), end.Sub(start).Seconds())
 }
 
 func (server *csearchServer) openHandler(w http.ResponseWriter, r *http.Request) {
@@ -209,6 +689,13 @@ func (server *csearchServer) openHandler(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		panic(err)
 	}
+	// only count files that were opened
+	if server.frecency != nil {
+		err = server.frecency.Use(path, time.Now())
+		if err != nil {
+			log.Printf("failed to record opened file: %s", err)
+		}
+	}
 	w.Write([]byte("OK!"))
 }
 
@@ -226,11 +713,106 @@ func logRequests(handler http.Handler) http.Handler {
 	})
 }
 
+// Opens the existing index, and checks all of it if verify is set.
+func openIndex(verify bool) (*reindex.ShardedIndex, error) {
+	ix, err := reindex.OpenSharded(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if verify {
+		start := time.Now()
+		err = ix.Verify()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("verified %s in %f seconds", indexPath, time.Since(start).Seconds())
+	}
+	return ix, nil
+}
+
+// The flags that control how the index is built.
+type indexOptions struct {
+	textLimits []reindex.TextLimits
+	shardBy    string
+	shards     int
+	workers    int
+	// in bytes, or 0 for the default
+	memory int64
+}
+
+// Indexes sourcePaths, replacing the existing index only once the new one is complete. Prints
+// the progress, and passes it to progress if it is not nil.
+func buildIndex(sourcePaths []string, shouldIndex func(string, os.FileInfo) bool, options indexOptions,
+	progress func(reindex.Progress)) (*reindex.ShardedIndex, error) {
+
+	fmt.Printf("Indexing %s ...\n", strings.Join(sourcePaths, ", "))
+	start := time.Now()
+	writer, err := reindex.CreateSharded(indexPath, options.shardBy, options.shards)
+	if err != nil {
+		return nil, err
+	}
+	writer.SetTextLimits(options.textLimits)
+	writer.Workers = options.workers
+	if options.memory > 0 {
+		writer.SetMemoryBudget(options.memory)
+	}
+	writer.Progress = func(p reindex.Progress) {
+		fmt.Printf("Indexing: %s\n", p)
+		if progress != nil {
+			progress(p)
+		}
+	}
+	err = reindex.IndexShardedTrees(writer, sourcePaths, shouldIndex)
+	if err != nil {
+		writer.Discard()
+		return nil, err
+	}
+	ix, err := reindex.FlushAndReopenSharded(writer)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	fmt.Printf("Done (%f seconds)\n", end.Sub(start).Seconds())
+	return ix, nil
+}
+
+// Returns the index with the file name matcher for the typeahead.
+func newSearchIndex(ix *reindex.ShardedIndex, typeaheadBudget time.Duration,
+	typeaheadTypos bool) *searchIndex {
+
+	fileMatcher := grep.NewShardedMatcher(0)
+	fileMatcher.PathBudget = typeaheadBudget
+	fileMatcher.Typos = typeaheadTypos
+	for _, shard := range ix.Shards() {
+		for i := 0; i < shard.NumNames(); i++ {
+			path := shard.Name(uint32(i))
+			fileMatcher.Add(path)
+		}
+	}
+	return &searchIndex{ix, fileMatcher, ix.Symbols()}
+}
+
 func main() {
 	skipIndexing := flag.Bool("skipIndexing", false, "do not index the source trees (uses existing index)")
+	verifyIndex := flag.Bool("verifyIndex", false,
+		"with -skipIndexing: check the whole existing index for corruption before using it")
 	port := flag.Int("port", 8080, "HTTP listening port")
 	stripPrefix := flag.String("stripPrefix", "", "Prefix to remove when displaying results")
 	skipPathsFlag := flag.String("skipPaths", "", "Subpaths to not index separated by :")
+	typeaheadBudget := flag.Duration("typeaheadBudget", 100*time.Millisecond,
+		"Time to spend finding the best path matches for the file name typeahead (0: find the best)")
+	useFrecency := flag.Bool("frecency", true,
+		"Rank files opened with /open higher in the typeahead; stored in "+frecencyPath)
+	typeaheadTypos := flag.Bool("typeaheadTypos", true,
+		"Match file names with one typo in the typeahead, if there are not enough exact matches")
+	textLimitsFlag := flag.String("textLimits", "",
+		"Limits for detecting text files by glob, separated by ; e.g. *.json:lineLen=20000,trigrams=50000,fileLen=1e9")
+	shards := flag.Int("shards", 1, "with -shardBy=hash: number of index shards, which are searched in parallel")
+	shardBy := flag.String("shardBy", reindex.ShardByHash,
+		"Divide files between index shards by: hash (of the path, into -shards shards) or root (one shard per source tree)")
+	indexWorkers := flag.Int("indexWorkers", 0, "Number of files to read at once while indexing (0: GOMAXPROCS)")
+	indexMemory := flag.Int("indexMemory", 0,
+		"MB of memory for indexing: 64 for each worker (using at most half), the rest holds trigrams, divided between shards (0: 64 per worker and 128 per shard)")
 
 	flag.Parse()
 	if flag.NArg() == 0 {
@@ -239,6 +821,15 @@ func main() {
 		os.Exit(1)
 	}
 	sourcePaths := flag.Args()
+	textLimits, err := reindex.ParseTextLimits(*textLimitsFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if (*shardBy != reindex.ShardByHash && *shardBy != reindex.ShardByRoot) || *shards < 1 {
+		fmt.Fprintf(os.Stderr, "invalid -shardBy %#v or -shards %d\n", *shardBy, *shards)
+		os.Exit(1)
+	}
 
 	skipPathSet := map[string]struct{}{}
 	for _, v := range strings.Split(*skipPathsFlag, ":") {
@@ -252,34 +843,52 @@ func main() {
 		return true
 	}
 
-	var ix *index.Index
-	if !*skipIndexing {
-		fmt.Printf("Indexing %s ...\n", strings.Join(sourcePaths, ", "))
-		start := time.Now()
-		writer, err := reindex.Create(indexPath)
+	options := indexOptions{textLimits, *shardBy, *shards, *indexWorkers, int64(*indexMemory) << 20}
+	build := func(progress func(reindex.Progress)) (*searchIndex, error) {
+		ix, err := buildIndex(sourcePaths, shouldIndex, options, progress)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		for _, path := range sourcePaths {
-			err = reindex.IndexTree(writer, path, shouldIndex)
-			if err != nil {
-				panic(err)
-			}
+		return newSearchIndex(ix, *typeaheadBudget, *typeaheadTypos), nil
+	}
+
+	var ix *reindex.ShardedIndex
+	var index *searchIndex
+	if *skipIndexing {
+		ix, err = openIndex(*verifyIndex)
+		if err != nil {
+			// rebuild a missing or corrupt index rather than failing
+			fmt.Printf("Cannot use the existing index: %s\n", err.Error())
+			ix = nil
+		}
+	}
+	if ix == nil {
+		index, err = build(nil)
+		if err != nil {
+			panic(err)
 		}
-		ix = reindex.FlushAndReopen(writer, indexPath)
-		writer = nil
-		end := time.Now()
-		fmt.Printf("Done (%f seconds)\n", end.Sub(start).Seconds())
 	} else {
-		ix = index.Open(indexPath)
+		index = newSearchIndex(ix, *typeaheadBudget, *typeaheadTypos)
 	}
 
-	indexedMatcher := grep.IndexedMatcher{}
-	for i := 0; i < ix.NumNames(); i++ {
-		path := ix.Name(uint32(i))
-		indexedMatcher.Add(path)
+	historyStore, err := history.Open(historyPath)
+	if err != nil {
+		panic(err)
+	}
+	var frecency *history.Frecency
+	if *useFrecency {
+		frecency, err = history.OpenFrecency(frecencyPath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	server := &csearchServer{
+		index:       index,
+		history:     historyStore,
+		frecency:    frecency,
+		stripPrefix: *stripPrefix,
+		build:       build,
 	}
-	server := csearchServer{ix, &indexedMatcher, *stripPrefix}
 
 	http.HandleFunc("/favicon.ico", favicon)
 	const staticPrefix = "/static/"
@@ -288,12 +897,20 @@ func main() {
 	http.Handle(staticPrefix, staticHandler)
 	http.Handle("/", http.HandlerFunc(server.handler))
 	http.Handle("/search", http.HandlerFunc(server.searchHandler))
+	http.Handle("/api/search", http.HandlerFunc(server.apiSearchHandler))
+	http.Handle("/save", http.HandlerFunc(server.saveHandler))
+	http.Handle("/api/history", http.HandlerFunc(server.apiHistoryHandler))
+	http.Handle("/api/saved", http.HandlerFunc(server.apiSavedHandler))
 	http.Handle("/type", http.HandlerFunc(server.typeaheadHandler))
+	http.Handle("/api/type", http.HandlerFunc(server.apiTypeaheadHandler))
+	http.Handle("/symbols", http.HandlerFunc(server.symbolsHandler))
 	http.Handle("/open", http.HandlerFunc(server.openHandler))
+	http.Handle("/status", http.HandlerFunc(server.statusHandler))
+	http.Handle("/reindex", http.HandlerFunc(server.reindexHandler))
 
 	portString := "localhost:" + strconv.Itoa(*port)
 	fmt.Printf("Listening on http://%s/\n", portString)
-	err := http.ListenAndServe(portString, logRequests(http.DefaultServeMux))
+	err = http.ListenAndServe(portString, logRequests(http.DefaultServeMux))
 	if err != nil {
 		panic(err)
 	}
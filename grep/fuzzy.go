@@ -1,9 +1,11 @@
 package grep
 
 import (
+	"container/heap"
 	"path"
 	"sort"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -26,18 +28,26 @@ func asciiToLower(b byte) byte {
 	return byte(c)
 }
 
-// Returns true if s contains all the bytes in query in order, with any number of additional bytes
-// between them. It matches ASCII in a case-insensitive way.
-func containsBytesFuzzyInsensitive(s string, query string) bool {
+// Returns true if s contains all the runes in query in order, with any number of additional runes
+// between them. It compares the lowercase form of runes. ASCII bytes use a fast path, until the
+// first non-ASCII byte in s.
+func containsFuzzyInsensitive(s string, query string) bool {
 	// this is ridiculously over-optimized
 	// We unconditionally set the magicLowerBit for an approximate case-insensitive comparison
 	// if they are equal, we execute asciiToLower(), which is signficantly slower
 	// this is about ~25% faster than always calling asciiToLower
 	const magicLowerBit = 0x20
 	qIndex := 0
+	if query[qIndex] >= utf8.RuneSelf {
+		return containsRunesFuzzyInsensitive(s, query)
+	}
 	qByteMaybeLower := query[qIndex] | magicLowerBit
 	qByteLower := asciiToLower(query[qIndex])
 	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			// the matched bytes are ASCII, so this splits both on rune boundaries
+			return containsRunesFuzzyInsensitive(s[i:], query[qIndex:])
+		}
 		sByteMaybeLower := s[i] | magicLowerBit
 		if sByteMaybeLower == qByteMaybeLower {
 			// now ACTUALLY check lowercase
@@ -46,6 +56,9 @@ func containsBytesFuzzyInsensitive(s string, query string) bool {
 				if qIndex == len(query) {
 					return true
 				}
+				if query[qIndex] >= utf8.RuneSelf {
+					return containsRunesFuzzyInsensitive(s[i+1:], query[qIndex:])
+				}
 				qByteMaybeLower = query[qIndex] | magicLowerBit
 				qByteLower = asciiToLower(query[qIndex])
 			}
@@ -54,16 +67,105 @@ func containsBytesFuzzyInsensitive(s string, query string) bool {
 	return false
 }
 
-func toRunes(s string) []rune {
-	if !utf8.ValidString(s) {
-		panic("invalid utf8 input")
+// containsRunesFuzzyInsensitive is the slow path of containsFuzzyInsensitive. Invalid UTF-8
+// bytes are treated as utf8.RuneError.
+func containsRunesFuzzyInsensitive(s string, query string) bool {
+	qRune, qSize := utf8.DecodeRuneInString(query)
+	qRuneLower := unicode.ToLower(qRune)
+	for _, sRune := range s {
+		if unicode.ToLower(sRune) == qRuneLower {
+			query = query[qSize:]
+			if len(query) == 0 {
+				return true
+			}
+			qRune, qSize = utf8.DecodeRuneInString(query)
+			qRuneLower = unicode.ToLower(qRune)
+		}
 	}
-	l := utf8.RuneCountInString(s)
-	runes := make([]rune, 0, l)
-	for _, r := range s {
-		runes = append(runes, r)
+	return false
+}
+
+// Returns true if s contains the runes in lowerQuery in order, except for at most one of them,
+// with any number of additional runes between them. It compares the lowercase form of runes.
+func containsFuzzyInsensitiveTypo(s string, lowerQuery []rune) bool {
+	// matched runes with no typo, and with one rune of lowerQuery skipped
+	matched := 0
+	typoMatched := 0
+	for _, sRune := range s {
+		if typoMatched < matched+1 {
+			typoMatched = matched + 1
+		}
+		if typoMatched >= len(lowerQuery) {
+			return true
+		}
+		sRuneLower := unicode.ToLower(sRune)
+		if sRuneLower == lowerQuery[typoMatched] {
+			typoMatched += 1
+		}
+		if sRuneLower == lowerQuery[matched] {
+			matched += 1
+		}
 	}
-	return runes
+	return matched+1 >= len(lowerQuery) || typoMatched >= len(lowerQuery)
+}
+
+// Returns the byte offsets in s of the first match of query, comparing the lowercase form
+// of runes, or -1, -1 if it does not match.
+func indexFold(s string, query string) (int, int) {
+	if isASCII(s) && isASCII(query) {
+		return indexLowerASCII(strings.ToLower(s), strings.ToLower(query))
+	}
+	queryLower := []rune(query)
+	for i, r := range queryLower {
+		queryLower[i] = unicode.ToLower(r)
+	}
+	for start := 0; start < len(s); {
+		if end := hasPrefixFold(s, start, queryLower); end >= 0 {
+			return start, end
+		}
+		_, size := utf8.DecodeRuneInString(s[start:])
+		start += size
+	}
+	return -1, -1
+}
+
+// indexLowerASCII is indexFold for ASCII strings that are already lowercase.
+func indexLowerASCII(lowerS string, lowerQuery string) (int, int) {
+	index := strings.Index(lowerS, lowerQuery)
+	if index < 0 {
+		return -1, -1
+	}
+	return index, index + len(lowerQuery)
+}
+
+// Returns the end offset of queryLower if it matches s at start, or -1.
+func hasPrefixFold(s string, start int, queryLower []rune) int {
+	end := start
+	for _, qRune := range queryLower {
+		if end == len(s) {
+			return -1
+		}
+		sRune, size := utf8.DecodeRuneInString(s[end:])
+		if unicode.ToLower(sRune) != qRune {
+			return -1
+		}
+		end += size
+	}
+	return end
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the runes in s. Invalid UTF-8 bytes are utf8.RuneError, the same as range over s.
+func toRunes(s string) []rune {
+	return []rune(s)
 }
 
 // A word begins when the previous rune is a non-letter (_example), or if there is a lowercase
@@ -100,73 +202,167 @@ const maxLengthPenalty = 80
 // * Path substring match (same bonuses)
 // * Filename fuzzy match (all chars in filename)
 // * path + filename match
-func fuzzyMatchPathAndFile(filepath string, filename string, query string) int {
-	// this filter is "incorrect":
-	// * false positive: matches BYTES, so it can incorrectly match UTF-8 byte parts. (see unit test)
-	// * false negative: doesn't lowercase non-ASCII
-	if !containsBytesFuzzyInsensitive(filepath, query) {
-		return -1
+// If positions is not nil, the rune indexes in filepath that matched query are appended.
+func fuzzyMatchPathAndFile(filepath string, filename string, query string, positions []int) (int, []int) {
+	if !containsFuzzyInsensitive(filepath, query) {
+		return -1, positions
 	}
 
-	score := fuzzyMatchFile(filename, query)
+	start := len(positions)
+	score, positions := fuzzyMatchFile(filename, query, positions)
 	if score >= 0 {
-		return score
+		if positions != nil && strings.HasSuffix(filepath, filename) {
+			// convert positions in filename to positions in filepath
+			offset := utf8.RuneCountInString(filepath[:len(filepath)-len(filename)])
+			for i := start; i < len(positions); i++ {
+				positions[i] += offset
+			}
+		}
+		return score, positions
 	}
 
 	// path fuzzy match
-	return scoreFuzzyStrings(filepath, query)
+	return scoreFuzzyStrings(filepath, query, positions[:start])
 }
 
-func fuzzyMatchFile(filename string, query string) int {
+// If positions is not nil, the rune indexes in filename that matched query are appended.
+func fuzzyMatchFile(filename string, query string, positions []int) (int, []int) {
 	// file name prefix and substring match
 	// do a fast test before slow scoring (minor performance win)
-	if !containsBytesFuzzyInsensitive(filename, query) {
-		return -1
+	if !containsFuzzyInsensitive(filename, query) {
+		return -1, positions
 	}
+	start, end := indexFold(filename, query)
+	return scoreFileName(filename, query, start, end, positions)
+}
+
+// scoreFileName is fuzzyMatchFile without the prefilter, given the byte offsets in filename
+// of the first substring match of query, or -1 if it is not a substring.
+func scoreFileName(filename string, query string, start int, end int, positions []int) (int, []int) {
+	if start >= 0 {
+		if positions != nil {
+			first := utf8.RuneCountInString(filename[:start])
+			for i := 0; i < utf8.RuneCountInString(filename[start:end]); i++ {
+				positions = append(positions, first+i)
+			}
+		}
 
-	index := strings.Index(strings.ToLower(filename), strings.ToLower(query))
-	if index >= 0 {
 		lengthPenalty := len(filename) - len(query)
 		if lengthPenalty > maxLengthPenalty {
 			lengthPenalty = maxLengthPenalty
 		}
 		caseScore := 0
-		if strings.HasPrefix(filename[index:], query) {
+		if strings.HasPrefix(filename[start:], query) {
 			caseScore = caseMatchBonus
 		}
-		if index == 0 {
-			return fileNamePrefixScore + caseScore - lengthPenalty
-		}
-		prevRune, _ := utf8.DecodeLastRuneInString(filename[:index])
-		firstMatchRune, _ := utf8.DecodeRuneInString(filename[index:])
-		if prevRune == utf8.RuneError || firstMatchRune == utf8.RuneError {
-			panic("unexpected rune error: invalid UTF-8 filename?")
+		if start == 0 {
+			return fileNamePrefixScore + caseScore - lengthPenalty, positions
 		}
+		// invalid UTF-8 decodes as utf8.RuneError, which is not a letter
+		prevRune, _ := utf8.DecodeLastRuneInString(filename[:start])
+		firstMatchRune, _ := utf8.DecodeRuneInString(filename[start:])
 		if isWordStart(prevRune, firstMatchRune) {
-			return fileNameWordPrefixScore + caseScore - lengthPenalty
+			return fileNameWordPrefixScore + caseScore - lengthPenalty, positions
 		}
-		return fileNameSubstringScore + caseScore - lengthPenalty
+		return fileNameSubstringScore + caseScore - lengthPenalty, positions
 	}
 
 	// file name fuzzy match
-	score := scoreFuzzyStrings(filename, query)
+	score, positions := scoreFuzzyStrings(filename, query, positions)
 	if score >= 0 {
-		return score + fileNameMatchScore
+		return score + fileNameMatchScore, positions
 	}
-	return -1
+	return -1, positions
 }
 
+// Queries with at least this many runes match with one typo, when typos are allowed
+const minTypoQueryLength = 5
+
+// Returns the runes in query, in lowercase.
+func lowerRunes(query string) []rune {
+	runes := toRunes(query)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// Returns the best score of query with one rune removed. Since the runes in query may be
+// separated by any others, this matches a missing, extra, substituted or transposed rune.
+// If positions is not nil, the rune indexes in filepath of the best match are appended.
+func fuzzyMatchPathTypo(filepath string, filename string, query string, lowerQuery []rune,
+	positions []int) (int, []int) {
+
+	if len(lowerQuery) < minTypoQueryLength || !containsFuzzyInsensitiveTypo(filepath, lowerQuery) {
+		return -1, positions
+	}
+	start := len(positions)
+	bestScore := -1
+	var bestPositions []int
+	for i := 0; i < len(query); {
+		_, size := utf8.DecodeRuneInString(query[i:])
+		var variantPositions []int
+		if positions != nil {
+			variantPositions = make([]int, 0, len(query))
+		}
+		score, variantPositions := fuzzyMatchPathAndFile(filepath, filename, query[:i]+query[i+size:],
+			variantPositions)
+		if score > bestScore {
+			bestScore = score
+			bestPositions = variantPositions
+		}
+		i += size
+	}
+	if bestScore >= 0 && positions != nil {
+		positions = append(positions[:start], bestPositions...)
+	}
+	return bestScore, positions
+}
+
+// FuzzyMatchPath returns how well query matches filepath, or a negative value if it does not.
+// Space separated terms in query must all match, and their scores are added. Terms with
+// slashes match path components in order: grep/fuz matches grep/fuzzy.go but not fuzzy/grep.go.
 func FuzzyMatchPath(filepath string, query string) int {
+	q := parseFuzzyQuery(query)
+	score, _ := fuzzyMatchTerms(filepath, path.Base(filepath), &q, nil)
+	return score
+}
+
+// FuzzyMatchPathPositions is like FuzzyMatchPath, but also returns the indexes of the runes
+// in filepath that matched query, for highlighting. The positions are nil if there is no match.
+func FuzzyMatchPathPositions(filepath string, query string) (int, []int) {
+	q := parseFuzzyQuery(query)
+	score, positions := fuzzyMatchTerms(filepath, path.Base(filepath), &q, make([]int, 0, len(query)))
+	if score < 0 {
+		return score, nil
+	}
+	return score, positions
+}
+
+// FuzzyMatchPathTypos is like FuzzyMatchPath, but if query does not match and is at least
+// minTypoQueryLength runes long, it matches with one missing, extra, substituted or transposed
+// rune. It returns true if the match has a typo: these should rank below all exact matches.
+// Queries with several terms or slashes must match exactly.
+func FuzzyMatchPathTypos(filepath string, query string) (int, bool) {
 	filename := path.Base(filepath)
-	return fuzzyMatchPathAndFile(filepath, filename, query)
+	q := parseFuzzyQuery(query)
+	score, _ := fuzzyMatchTerms(filepath, filename, &q, nil)
+	if score >= 0 || !q.simple() {
+		return score, false
+	}
+	query = q.terms[0].text
+	score, _ = fuzzyMatchPathTypo(filepath, filename, query, lowerRunes(query), nil)
+	return score, score >= 0
 }
 
-// Returns the score for string matches, ignoring path-specific information
-func scoreFuzzyStrings(s string, query string) int {
+// Returns the score for string matches, ignoring path-specific information. If positions is
+// not nil, the rune indexes in s that matched query are appended.
+func scoreFuzzyStrings(s string, query string, positions []int) (int, []int) {
 	qRunes := toRunes(query)
 
 	score := 0
 	qIndex := 0
+	sIndex := 0
 	previousRune := wordStartInitialRune
 	for _, sRune := range s {
 		qRuneLower := unicode.ToLower(qRunes[qIndex])
@@ -176,35 +372,77 @@ func scoreFuzzyStrings(s string, query string) int {
 			if isWordStart(previousRune, sRune) {
 				score += 1
 			}
+			if positions != nil {
+				positions = append(positions, sIndex)
+			}
 			qIndex += 1
 			if qIndex == len(qRunes) {
 				break
 			}
 		}
 		previousRune = sRune
+		sIndex += 1
 	}
 	if qIndex != len(qRunes) {
-		return -1
+		return -1, positions
 	}
-	return score
+	return score, positions
 }
 
 type fuzzyMatch struct {
 	score int
+	typo  bool
 	value string
 }
 
-type fuzzyMatches []*fuzzyMatch
+// better returns true if a should be ranked before b: matches without typos first, then
+// higher scores, then shorter paths, then in lexicographic order. This makes the results
+// independent of input order.
+func (a *fuzzyMatch) better(b *fuzzyMatch) bool {
+	if a.typo != b.typo {
+		return !a.typo
+	}
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	if len(a.value) != len(b.value) {
+		return len(a.value) < len(b.value)
+	}
+	return a.value < b.value
+}
+
+// fuzzyMatches sorts best first.
+type fuzzyMatches []fuzzyMatch
 
 func (a fuzzyMatches) Len() int           { return len(a) }
 func (a fuzzyMatches) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a fuzzyMatches) Less(i, j int) bool { return a[i].score > a[j].score }
+func (a fuzzyMatches) Less(i, j int) bool { return a[i].better(&a[j]) }
+
+// fuzzyHeap is a min-heap: the worst match is at the root, so it can be replaced when a
+// better match is found.
+type fuzzyHeap []fuzzyMatch
+
+func (h fuzzyHeap) Len() int            { return len(h) }
+func (h fuzzyHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h fuzzyHeap) Less(i, j int) bool  { return h[j].better(&h[i]) }
+func (h *fuzzyHeap) Push(x interface{}) { *h = append(*h, x.(fuzzyMatch)) }
+func (h *fuzzyHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
 
+// FuzzyMatcher collects the best Limit matches for Query. If Limit <= 0, it collects all
+// matches.
 type FuzzyMatcher struct {
 	Query        string
 	Limit        int
-	results      []*fuzzyMatch
+	results      fuzzyHeap
 	totalMatches int
+	exactMatches int
+	// Query split into terms; nil until needed
+	parsed *fuzzyQuery
 }
 
 func assert(v bool) {
@@ -214,26 +452,38 @@ func assert(v bool) {
 }
 
 func (matcher *FuzzyMatcher) addResult(filepath string, score int) {
-	assert(score >= 0)
+	matcher.add(fuzzyMatch{score, false, filepath})
+}
+
+func (matcher *FuzzyMatcher) add(match fuzzyMatch) {
+	assert(match.score >= 0)
 	matcher.totalMatches += 1
-	if matcher.Limit <= 0 || len(matcher.results) < matcher.Limit {
-		match := &fuzzyMatch{score, filepath}
+	if !match.typo {
+		matcher.exactMatches += 1
+	}
+	if matcher.Limit <= 0 {
+		// no limit: no need to maintain the heap
 		matcher.results = append(matcher.results, match)
-	} else {
-		assert(matcher.Limit > 0 && len(matcher.results) == matcher.Limit)
-		// TODO: Make this faster? This is a naive n**2 algorithm
-		for _, r := range matcher.results {
-			if r.score < score {
-				r.score = score
-				r.value = filepath
-				break
-			}
-		}
+	} else if len(matcher.results) < matcher.Limit {
+		heap.Push(&matcher.results, match)
+	} else if match.better(&matcher.results[0]) {
+		// replace the worst match
+		matcher.results[0] = match
+		heap.Fix(&matcher.results, 0)
+	}
+}
+
+func (matcher *FuzzyMatcher) query() *fuzzyQuery {
+	if matcher.parsed == nil {
+		q := parseFuzzyQuery(matcher.Query)
+		matcher.parsed = &q
 	}
+	return matcher.parsed
 }
 
+// matchFile only matches file names, so it must only be used for simple queries.
 func (matcher *FuzzyMatcher) matchFile(filepath string, filename string) bool {
-	score := fuzzyMatchFile(filename, matcher.Query)
+	score, _ := fuzzyMatchFile(filename, matcher.query().terms[0].text, nil)
 	if score >= 0 {
 		matcher.addResult(filepath, score)
 		return true
@@ -241,10 +491,35 @@ func (matcher *FuzzyMatcher) matchFile(filepath string, filename string) bool {
 	return false
 }
 
-func (matcher *FuzzyMatcher) matchPathAndFile(filepath string, filename string) {
-	score := fuzzyMatchPathAndFile(filepath, filename, matcher.Query)
+func (matcher *FuzzyMatcher) matchPathAndFile(filepath string, filename string) bool {
+	score, _ := fuzzyMatchTerms(filepath, filename, matcher.query(), nil)
 	if score >= 0 {
 		matcher.addResult(filepath, score)
+		return true
+	}
+	return false
+}
+
+// matchTypo must only be called for simple queries, and paths that did not match. lowerQuery
+// is lowerRunes of the query term.
+func (matcher *FuzzyMatcher) matchTypo(filepath string, filename string, lowerQuery []rune) {
+	score, _ := fuzzyMatchPathTypo(filepath, filename, matcher.query().terms[0].text, lowerQuery, nil)
+	if score >= 0 {
+		matcher.add(fuzzyMatch{score, true, filepath})
+	}
+}
+
+// matchBoosted adds boost to the score of filepath if it matches, including with a typo if
+// lowerQuery is not nil (see matchTypo). Boosted paths must not be matched any other way.
+func (matcher *FuzzyMatcher) matchBoosted(filepath string, filename string, boost int, lowerQuery []rune) {
+	score, _ := fuzzyMatchTerms(filepath, filename, matcher.query(), nil)
+	typo := false
+	if score < 0 && lowerQuery != nil {
+		score, _ = fuzzyMatchPathTypo(filepath, filename, matcher.query().terms[0].text, lowerQuery, nil)
+		typo = true
+	}
+	if score >= 0 {
+		matcher.add(fuzzyMatch{score + boost, typo, filepath})
 	}
 }
 
@@ -253,15 +528,52 @@ func (matcher *FuzzyMatcher) Match(filepath string) {
 	matcher.matchPathAndFile(filepath, filename)
 }
 
+// sortedResults returns a sorted copy of the results, so more matches can be added.
+func (matcher *FuzzyMatcher) sortedResults() fuzzyMatches {
+	sorted := append(fuzzyMatches(nil), matcher.results...)
+	sort.Sort(sorted)
+	return sorted
+}
+
+// Results returns the matched paths, best first.
 func (matcher *FuzzyMatcher) Results() []string {
-	sort.Sort(fuzzyMatches(matcher.results))
-	out := make([]string, len(matcher.results))
-	for i, match := range matcher.results {
+	sorted := matcher.sortedResults()
+	out := make([]string, len(sorted))
+	for i, match := range sorted {
 		out[i] = match.value
 	}
 	return out
 }
 
+// FuzzyResult is a path that matched a fuzzy query.
+type FuzzyResult struct {
+	Path  string
+	Score int
+	// Indexes of the runes in Path that matched the query
+	Positions []int
+	// True if Path only matched the query with one typo
+	Typo bool
+}
+
+// ResultsWithPositions is like Results, but also returns the scores and matched positions.
+func (matcher *FuzzyMatcher) ResultsWithPositions() []FuzzyResult {
+	sorted := matcher.sortedResults()
+	out := make([]FuzzyResult, len(sorted))
+	for i, match := range sorted {
+		// only compute positions for the results: it is slower than scoring
+		var positions []int
+		if match.typo {
+			query := matcher.query().terms[0].text
+			_, positions = fuzzyMatchPathTypo(match.value, path.Base(match.value), query,
+				lowerRunes(query), []int{})
+		} else {
+			_, positions = FuzzyMatchPathPositions(match.value, matcher.Query)
+		}
+		out[i] = FuzzyResult{match.value, match.score, positions, match.typo}
+	}
+	return out
+}
+
 func (matcher *FuzzyMatcher) TotalMatches() int {
 	return matcher.totalMatches
 }
@@ -271,13 +583,28 @@ type indexedPath struct {
 	filename string
 }
 
+// IndexedMatcher matches a fixed set of paths. By default it returns the best matches
+// (strict top K). Setting PathBudget bounds the latency, possibly missing the best matches.
 type IndexedMatcher struct {
+	// If > 0, stop looking for path matches once Match has run for this long. Matches on
+	// file names are always found, and rank above path matches, so this only loses results
+	// when there are fewer than limit file name matches. Queries with several terms or slashes
+	// match all paths in one pass, so may also lose file name matches.
+	PathBudget time.Duration
+
+	// If true and there are fewer than limit matches, also match paths with one typo in
+	// queries of at least minTypoQueryLength runes. These rank below all other matches.
+	Typos bool
+
 	// TODO: Use two separate arrays for slightly better cache locality?
 	// TODO: ~35% of file paths are lowercase only (slightly more file names); could
 	// avoid calling .ToLower for paths that are known lowercase?
 	paths []*indexedPath
 }
 
+// number of paths to match between checks of PathBudget
+const budgetCheckInterval = 1024
+
 func (matcher *IndexedMatcher) Add(filepath string) {
 	filename := path.Base(filepath)
 	indexed := indexedPath{filepath, filename}
@@ -285,30 +612,96 @@ func (matcher *IndexedMatcher) Add(filepath string) {
 }
 
 func (matcher *IndexedMatcher) Match(query string, limit int) []string {
-	// match file names first, then add results with patch matches
-	fuzzy := FuzzyMatcher{Query: query, Limit: limit}
-	matched := map[int]struct{}{}
+	return matcher.match(query, limit, nil).Results()
+}
+
+// MatchWithPositions is like Match, but also returns the scores and the matched positions.
+func (matcher *IndexedMatcher) MatchWithPositions(query string, limit int) []FuzzyResult {
+	return matcher.match(query, limit, nil).ResultsWithPositions()
+}
+
+// MatchWithBoosts is like MatchWithPositions, but adds boosts[path] to the score of matching
+// paths, e.g. to rank frequently used files higher. Typo matches still rank below exact ones.
+func (matcher *IndexedMatcher) MatchWithBoosts(query string, limit int, boosts map[string]int) []FuzzyResult {
+	return matcher.match(query, limit, boosts).ResultsWithPositions()
+}
+
+// MatchResults returns the matcher with the results, to get both ResultsWithPositions and
+// TotalMatches. boosts may be nil: see MatchWithBoosts.
+func (matcher *IndexedMatcher) MatchResults(query string, limit int, boosts map[string]int) *FuzzyMatcher {
+	return matcher.match(query, limit, boosts)
+}
+
+func (matcher *IndexedMatcher) match(query string, limit int, boosts map[string]int) *FuzzyMatcher {
+	start := time.Now()
+	outOfTime := func(i int) bool {
+		return matcher.PathBudget > 0 && i%budgetCheckInterval == 0 && time.Since(start) > matcher.PathBudget
+	}
+
+	parsed := parseFuzzyQuery(query)
+	fuzzy := FuzzyMatcher{Query: query, Limit: limit, parsed: &parsed}
+	if !parsed.simple() {
+		// the file names cannot be matched first: match all paths in one pass
+		for i, indexed := range matcher.paths {
+			if i > 0 && outOfTime(i) {
+				break
+			}
+			if boost, ok := boosts[indexed.filepath]; ok {
+				fuzzy.matchBoosted(indexed.filepath, indexed.filename, boost, nil)
+			} else {
+				fuzzy.matchPathAndFile(indexed.filepath, indexed.filename)
+			}
+		}
+		return &fuzzy
+	}
+	query = parsed.terms[0].text
+	var lowerQuery []rune
+	if matcher.Typos {
+		lowerQuery = lowerRunes(query)
+	}
+
+	// match file names first, then add results with path matches
+	matched := make([]bool, len(matcher.paths))
+	fileMatches := 0
 	for i, indexed := range matcher.paths {
-		if fuzzy.matchFile(indexed.filepath, indexed.filename) {
-			matched[i] = struct{}{}
+		if boost, ok := boosts[indexed.filepath]; ok {
+			// boosted paths may rank anywhere: always match them
+			fuzzy.matchBoosted(indexed.filepath, indexed.filename, boost, lowerQuery)
+			matched[i] = true
+			continue
+		}
+		matched[i] = fuzzy.matchFile(indexed.filepath, indexed.filename)
+		if matched[i] {
+			fileMatches += 1
 		}
 	}
-	if fuzzy.Limit > 0 && len(fuzzy.results) == fuzzy.Limit {
-		// found a full set of filename matches: we are done
-		return fuzzy.Results()
+	if limit > 0 && fileMatches >= limit {
+		// found a full set of filename matches: they score higher than any path match
+		return &fuzzy
 	}
 
 	for i, indexed := range matcher.paths {
-		if _, ok := matched[i]; ok {
-			// already matched
+		if i > 0 && outOfTime(i) {
+			// out of time: the results may be missing better path matches
+			return &fuzzy
+		}
+		if matched[i] {
 			continue
 		}
-		fuzzy.matchPathAndFile(indexed.filepath, indexed.filename)
-		if fuzzy.Limit > 0 && len(fuzzy.results) == fuzzy.Limit {
-			// don't care about finding the "best" path matches: this is probably enough
+		matched[i] = fuzzy.matchPathAndFile(indexed.filepath, indexed.filename)
+	}
+	if !matcher.Typos || (limit > 0 && fuzzy.exactMatches >= limit) {
+		return &fuzzy
+	}
+
+	// typo matches rank below all exact matches
+	for i, indexed := range matcher.paths {
+		if outOfTime(i) {
 			break
 		}
+		if !matched[i] {
+			fuzzy.matchTypo(indexed.filepath, indexed.filename, lowerQuery)
+		}
 	}
-
-	return fuzzy.Results()
+	return &fuzzy
 }
@@ -1,9 +1,12 @@
 package grep
 
 import (
+	"fmt"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 	"unicode"
 )
 
@@ -22,10 +25,10 @@ func TestIsWordStart(t *testing.T) {
 			lr := unicode.ToLower(r)
 			if lr == 's' || lr == 'w' {
 				if !isWordStart(previous, r) {
-					t.Errorf("%s: expected %c -> %c to be a word", previous, r)
+					t.Errorf("%s: expected %c -> %c to be a word", s, previous, r)
 				}
 			} else if isWordStart(previous, r) {
-				t.Errorf("%s: expected %c -> %c to not be a word", previous, r)
+				t.Errorf("%s: expected %c -> %c to not be a word", s, previous, r)
 			}
 			previous = r
 		}
@@ -111,6 +114,47 @@ func TestShorterFilenamesScoreHigher(t *testing.T) {
 	assertOrder(t, scoreOrder, "git")
 }
 
+func TestFuzzyMatchPathPositions(t *testing.T) {
+	tests := []struct {
+		path      string
+		query     string
+		positions []int
+	}{
+		// file name prefix, substring and fuzzy matches: offset by the directory
+		{"a/b/TypeAhead.java", "type", []int{4, 5, 6, 7}},
+		{"a/b/PlaceType.java", "type", []int{9, 10, 11, 12}},
+		{"a/b/TypeAhead.java", "tah", []int{4, 8, 9}},
+		// path fuzzy match
+		{"a/b/type/Foo.java", "typefoo", []int{4, 5, 6, 7, 9, 10, 11}},
+		{"a/b/ctyped/Foo.java", "type", []int{5, 6, 7, 8}},
+		// rune positions, not bytes
+		{"ü/é/naïve.txt", "ïv", []int{6, 7}},
+		{"ü/é/naïve.txt", "üna", []int{0, 4, 5}},
+		{"a/b/c", "zzz", nil},
+	}
+	for _, test := range tests {
+		score, positions := FuzzyMatchPathPositions(test.path, test.query)
+		if !reflect.DeepEqual(positions, test.positions) {
+			t.Errorf("FuzzyMatchPathPositions(%#v, %#v)=%v; expected %v",
+				test.path, test.query, positions, test.positions)
+		}
+		if score != FuzzyMatchPath(test.path, test.query) {
+			t.Errorf("%s: score %d must equal FuzzyMatchPath", test.path, score)
+		}
+	}
+}
+
+func TestIndexedMatcherWithPositions(t *testing.T) {
+	matcher := IndexedMatcher{}
+	matcher.Add("grep/fuzzy.go")
+	matcher.Add("reindex/search.go")
+	results := matcher.MatchWithPositions("fz", 0)
+	expected := []FuzzyResult{{"grep/fuzzy.go", FuzzyMatchPath("grep/fuzzy.go", "fz"), []int{5, 7}, false}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Error("unexpected results", results, expected)
+	}
+}
+
 func matchValues(matcher *FuzzyMatcher) {
 	values := []string{
 		"he-match-llo",
@@ -151,6 +195,72 @@ func TestFuzzyMatcherLimited(t *testing.T) {
 	}
 }
 
+func TestFuzzyMatcherTies(t *testing.T) {
+	// equal scores: shorter paths first, then lexicographic
+	matcher := FuzzyMatcher{Query: "abc"}
+	for _, v := range []string{"yy/abcd", "x/abcd", "z/abc", "y/abc", "w/abcd"} {
+		matcher.Match(v)
+	}
+	expected := []string{"y/abc", "z/abc", "w/abcd", "x/abcd", "yy/abcd"}
+	if output := matcher.Results(); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected results", expected, output)
+	}
+}
+
+// The limited matcher must return the true top K, independent of the input order.
+func TestFuzzyMatcherTopK(t *testing.T) {
+	lines := loadData()
+	const query = "src"
+	all := FuzzyMatcher{Query: query}
+	for _, l := range lines {
+		all.Match(l)
+	}
+	expected := all.Results()
+	if len(expected) < 100 {
+		t.Fatal("expected many matches in benchfiles.txt", len(expected))
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for _, limit := range []int{1, 2, 10, 99} {
+		for trial := 0; trial < 3; trial++ {
+			matcher := FuzzyMatcher{Query: query, Limit: limit}
+			for _, i := range random.Perm(len(lines)) {
+				matcher.Match(lines[i])
+			}
+			output := matcher.Results()
+			if !reflect.DeepEqual(expected[:limit], output) {
+				t.Errorf("limit %d: unexpected results %v; expected %v", limit, output, expected[:limit])
+			}
+			if matcher.TotalMatches() != len(expected) {
+				t.Errorf("limit %d: TotalMatches()=%d; expected %d", limit, matcher.TotalMatches(), len(expected))
+			}
+		}
+	}
+}
+
+func TestIndexedMatcherPathMatches(t *testing.T) {
+	// path-only matches: the best is at the end
+	matcher := IndexedMatcher{}
+	for i := 0; i < 5000; i++ {
+		matcher.Add(fmt.Sprintf("xaxbxc/%d", i))
+	}
+	matcher.Add("a/b/c/best")
+	matcher.Add("x/abc.txt")
+
+	// strict: finds the best path match, after the file name match
+	expected := []string{"x/abc.txt", "a/b/c/best"}
+	if output := matcher.Match("abc", 2); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected results", expected, output)
+	}
+
+	// bounded: gives up before reaching the best path match, but still has file name matches
+	matcher.PathBudget = time.Nanosecond
+	output := matcher.Match("abc", 2)
+	if len(output) != 2 || output[0] != "x/abc.txt" || output[1] == "a/b/c/best" {
+		t.Error("unexpected results with a time budget", output)
+	}
+}
+
 func TestContainsBytesFuzzy(t *testing.T) {
 	const query = "abcde"
 
@@ -177,33 +287,87 @@ func TestContainsBytesFuzzy(t *testing.T) {
 	}
 }
 
-func TestContainsBytesFuzzyInsensitive(t *testing.T) {
+func TestContainsFuzzyInsensitive(t *testing.T) {
 	const query = "abcde"
 
 	bad := []string{
-		// TODO: accent folding? unicode to lower?
+		// TODO: accent folding?
 		"abcdé",
 	}
 	good := []string{
 		"ABCDE",
 		"-A-B-C-D-E-",
+		"é-a-b-c-d-e",
 	}
 	for _, s := range bad {
-		if containsBytesFuzzyInsensitive(s, query) {
+		if containsFuzzyInsensitive(s, query) {
 			t.Error(s + " must not contain " + query + " (returned true)")
 		}
 	}
 	for _, s := range good {
-		if !containsBytesFuzzyInsensitive(s, query) {
+		if !containsFuzzyInsensitive(s, query) {
 			t.Error(s + " must contain " + query + " (returned false)")
 		}
 	}
 
-	// Known false positive: this is a *byte* match, not a string match
+	// runes are compared, not bytes
 	nbsp := "\u00a0"            // UTF-8: nbsp (c2 a0)
 	poundSDot := "\u00a3\u2260" // UTF-8: pound (c2 a3) NOT EQUAL TO (e2 89 a0)
-	if !containsBytesFuzzyInsensitive(poundSDot, nbsp) {
-		t.Error("expected match (bytes match, even though runes do not)")
+	if containsFuzzyInsensitive(poundSDot, nbsp) {
+		t.Error("expected no match (bytes match, but runes do not)")
+	}
+
+	unicodeTests := []struct {
+		s        string
+		query    string
+		expected bool
+	}{
+		{"ÉCOLE/naïve.txt", "école", true},
+		{"école", "ÉCOLE", true},
+		{"ΑΒΓ/δ", "αβγΔ", true},
+		// Kelvin sign lowercases to ASCII k
+		{"\u212aelvin", "kelvin", true},
+		{"kelvin", "\u212aelvin", true},
+		{"ab\xffc", "abc", true},
+		{"ab\xffc", "\xff", true},
+		{"abc", "\xff", false},
+	}
+	for i, test := range unicodeTests {
+		if containsFuzzyInsensitive(test.s, test.query) != test.expected {
+			t.Errorf("%d: containsFuzzyInsensitive(%#v, %#v) != %v", i, test.s, test.query, test.expected)
+		}
+	}
+}
+
+func TestUnicodeFuzzyMatchPath(t *testing.T) {
+	tests := []struct {
+		path      string
+		query     string
+		positions []int
+	}{
+		{"src/ÉCOLE.txt", "école", []int{4, 5, 6, 7, 8}},
+		{"docs/naïve/README", "NAÏVE", []int{5, 6, 7, 8, 9}},
+		// strings.ToLower changes the byte length of U+0130; positions are still runes
+		{"x/\u0130stanbul.go", "istanbul", []int{2, 3, 4, 5, 6, 7, 8, 9}},
+		// invalid UTF-8 must not panic
+		{"bad\xff/na\xffme.go", "name", []int{5, 6, 8, 9}},
+		{"bad\xff/\xffname.go", "name", []int{6, 7, 8, 9}},
+		{"bad/\xffx", "\xffx", []int{4, 5}},
+	}
+	for _, test := range tests {
+		score, positions := FuzzyMatchPathPositions(test.path, test.query)
+		if score < 0 || !reflect.DeepEqual(positions, test.positions) {
+			t.Errorf("FuzzyMatchPathPositions(%#v, %#v) = %d %v; expected positions %v",
+				test.path, test.query, score, positions, test.positions)
+		}
+	}
+
+	// prefix matches rank the same regardless of case or script
+	if FuzzyMatchPath("a/école.txt", "ÉCOLE") != FuzzyMatchPath("a/ecole.txt", "ECOLE") {
+		t.Error("unicode prefix match must score like ASCII")
+	}
+	if FuzzyMatchPath("a/b.txt", "é") >= 0 {
+		t.Error("é must not match ASCII")
 	}
 }
 
@@ -249,7 +413,7 @@ func BenchmarkContainsBytes(b *testing.B) {
 	}
 }
 
-func containsBytesFuzzyInsensitiveToLower(s string, query string) bool {
+func containsFuzzyInsensitiveToLower(s string, query string) bool {
 	sLower := strings.ToLower(s)
 	qLower := strings.ToLower(query)
 	return containsBytesFuzzy(sLower, qLower)
@@ -257,13 +421,13 @@ func containsBytesFuzzyInsensitiveToLower(s string, query string) bool {
 
 func BenchmarkContainsBytesInsensitiveToLower(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		containsBytesFuzzyInsensitiveToLower(s, query)
+		containsFuzzyInsensitiveToLower(s, query)
 	}
 }
 
 func BenchmarkContainsBytesInsensitive(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		containsBytesFuzzyInsensitive(s, query)
+		containsFuzzyInsensitive(s, query)
 	}
 }
 
@@ -286,3 +450,114 @@ func BenchmarkAsciiToLowerSlow(b *testing.B) {
 		asciiToLowerSlow('a')
 	}
 }
+
+func TestContainsFuzzyInsensitiveTypo(t *testing.T) {
+	tests := []struct {
+		s        string
+		query    string
+		expected bool
+	}{
+		{"search.go", "search", true},
+		{"search.go", "serach", true},
+		{"search.go", "saerch", true},
+		{"search.go", "seXrch", true},
+		{"search.go", "seaXrch", true},
+		{"search.go", "Xsearch", true},
+		{"search.go", "searchX", true},
+		{"search.go", "sXarXh", false},
+		{"search.go", "hcraes", false},
+		{"ÉCOLE.txt", "ecole", true},
+		{"ÉCOLE.txt", "qcolq", false},
+	}
+	for _, test := range tests {
+		if containsFuzzyInsensitiveTypo(test.s, lowerRunes(test.query)) != test.expected {
+			t.Errorf("containsFuzzyInsensitiveTypo(%#v, %#v) != %v", test.s, test.query, test.expected)
+		}
+	}
+}
+
+func TestFuzzyMatchPathTypos(t *testing.T) {
+	score, typo := FuzzyMatchPathTypos("reindex/search.go", "search.go")
+	if score != FuzzyMatchPath("reindex/search.go", "search.go") || typo {
+		t.Error("exact matches must not be typos", score, typo)
+	}
+	for _, query := range []string{"serach.go", "saerch", "seerch", "searchh"} {
+		score, typo = FuzzyMatchPathTypos("reindex/search.go", query)
+		if score < 0 || !typo {
+			t.Errorf("%#v must match with a typo: %d %v", query, score, typo)
+		}
+	}
+	// short queries require exact matches
+	if score, _ = FuzzyMatchPathTypos("reindex/search.go", "sae"); score >= 0 {
+		t.Error("short queries must not allow typos", score)
+	}
+	if score, _ = FuzzyMatchPathTypos("reindex/search.go", "sXarXh"); score >= 0 {
+		t.Error("two typos must not match", score)
+	}
+}
+
+func TestIndexedMatcherTypos(t *testing.T) {
+	matcher := IndexedMatcher{}
+	for _, p := range []string{"reindex/search.go", "serach/notes.txt", "grep/grep.go", "reindex/seerch.go"} {
+		matcher.Add(p)
+	}
+	if output := matcher.Match("serach.go", 0); len(output) != 0 {
+		t.Error("typos must be disabled by default", output)
+	}
+
+	matcher.Typos = true
+	results := matcher.MatchWithPositions("serach", 0)
+	paths := []string{}
+	for _, result := range results {
+		paths = append(paths, result.Path)
+	}
+	// exact match first, then typo matches in score order
+	expected := []string{"serach/notes.txt", "reindex/search.go", "reindex/seerch.go"}
+	if !reflect.DeepEqual(expected, paths) {
+		t.Error("unexpected results", expected, paths)
+	}
+	if results[0].Typo || !results[1].Typo || !reflect.DeepEqual(results[1].Positions, []int{8, 9, 10, 12, 13}) {
+		t.Error("unexpected typo results", results)
+	}
+
+	// typo matches are only needed when the exact matches do not fill the limit
+	if output := matcher.Match("serach", 1); !reflect.DeepEqual(output, expected[:1]) {
+		t.Error("unexpected limited results", output)
+	}
+}
+
+func TestIndexedMatcherBoosts(t *testing.T) {
+	matcher := IndexedMatcher{}
+	for i := 0; i < 10; i++ {
+		matcher.Add(fmt.Sprintf("dir%d/search.go", i))
+	}
+	matcher.Add("x/s/e/a/r/c/h/main.go")
+	matcher.Add("lib/serach/util.go")
+
+	paths := func(results []FuzzyResult) []string {
+		out := []string{}
+		for _, result := range results {
+			out = append(out, result.Path)
+		}
+		return out
+	}
+
+	// the file name matches fill the limit: boosted path matches must still be found
+	boosts := map[string]int{"x/s/e/a/r/c/h/main.go": 1000, "dir9/search.go": 50, "not/indexed.go": 1000}
+	results := matcher.MatchWithBoosts("search", 3, boosts)
+	expected := []string{"x/s/e/a/r/c/h/main.go", "dir9/search.go", "dir0/search.go"}
+	if !reflect.DeepEqual(expected, paths(results)) {
+		t.Error("unexpected boosted results", expected, paths(results))
+	}
+	if results[1].Score != FuzzyMatchPath("dir9/search.go", "search")+50 {
+		t.Error("boost must be added to the score", results[1])
+	}
+
+	// boosted typo matches still rank below exact matches
+	matcher.Typos = true
+	results = matcher.MatchWithBoosts("serach", 0, map[string]int{"dir3/search.go": 1000})
+	if len(results) != 12 || results[0].Path != "lib/serach/util.go" || results[1].Path != "dir3/search.go" ||
+		!results[1].Typo {
+		t.Error("unexpected boosted typo results", paths(results))
+	}
+}
@@ -0,0 +1,157 @@
+package grep
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// fuzzyQuery is a typeahead query split into space separated terms, which must all match.
+type fuzzyQuery struct {
+	terms []fuzzyTerm
+}
+
+// fuzzyTerm is one term of a query. Terms that contain slashes are split into segments that
+// must match path components in order, e.g. grep/fuz matches grep/fuzzy.go.
+type fuzzyTerm struct {
+	text string
+	// nil if text has no slashes
+	segments []string
+	// the segments without slashes, to quickly reject paths
+	joined string
+	// text ends with a slash: all segments must match directories
+	dirOnly bool
+}
+
+func parseFuzzyQuery(query string) fuzzyQuery {
+	var q fuzzyQuery
+	for _, text := range strings.Fields(query) {
+		term := fuzzyTerm{text: text}
+		if strings.IndexByte(text, '/') >= 0 {
+			for _, segment := range strings.Split(text, "/") {
+				if segment != "" {
+					term.segments = append(term.segments, segment)
+				}
+			}
+			if len(term.segments) == 0 {
+				// only slashes: matches everything
+				continue
+			}
+			term.joined = strings.Join(term.segments, "")
+			term.dirOnly = strings.HasSuffix(text, "/")
+		}
+		q.terms = append(q.terms, term)
+	}
+	return q
+}
+
+// simple returns true if the query is a single term without slashes, which is matched
+// against the whole path.
+func (q *fuzzyQuery) simple() bool {
+	return len(q.terms) == 1 && q.terms[0].segments == nil
+}
+
+// text returns all the characters that must match, to quickly reject paths.
+func (q *fuzzyQuery) text() string {
+	parts := make([]string, len(q.terms))
+	for i, term := range q.terms {
+		parts[i] = term.text
+		if term.segments != nil {
+			parts[i] = term.joined
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// Returns the sum of the scores of each term in q, or -1 if any does not match or q has no
+// terms. If positions is not nil, the rune indexes matched by any term are appended in order.
+func fuzzyMatchTerms(filepath string, filename string, q *fuzzyQuery, positions []int) (int, []int) {
+	if q.simple() {
+		return fuzzyMatchPathAndFile(filepath, filename, q.terms[0].text, positions)
+	}
+	if len(q.terms) == 0 {
+		return -1, positions
+	}
+
+	var termPositions []int
+	if positions != nil {
+		termPositions = []int{}
+	}
+	total := 0
+	for _, term := range q.terms {
+		score := 0
+		if term.segments == nil {
+			score, termPositions = fuzzyMatchPathAndFile(filepath, filename, term.text, termPositions)
+		} else {
+			score, termPositions = fuzzyMatchSegments(filepath, &term, termPositions)
+		}
+		if score < 0 {
+			return -1, positions
+		}
+		total += score
+	}
+
+	if positions != nil {
+		// terms may match the same runes
+		sort.Ints(termPositions)
+		for i, position := range termPositions {
+			if i == 0 || position != termPositions[i-1] {
+				positions = append(positions, position)
+			}
+		}
+	}
+	return total, positions
+}
+
+// Returns the score of matching term's segments to the components of filepath in order, or
+// -1 if they do not match. Each segment matches the first possible directory, except the last,
+// which prefers the file name. If positions is not nil, the matched rune indexes are appended.
+func fuzzyMatchSegments(filepath string, term *fuzzyTerm, positions []int) (int, []int) {
+	if !containsFuzzyInsensitive(filepath, term.joined) {
+		return -1, positions
+	}
+	components := strings.Split(filepath, "/")
+	fileIndex := len(components) - 1
+
+	score := 0
+	component := 0
+	offset := 0
+	last := len(term.segments) - 1
+	for i, segment := range term.segments {
+		if i == last && !term.dirOnly && containsFuzzyInsensitive(components[fileIndex], segment) {
+			for ; component < fileIndex; component++ {
+				offset += utf8.RuneCountInString(components[component]) + 1
+			}
+			start := len(positions)
+			segmentScore, segmentPositions := fuzzyMatchFile(components[component], segment, positions)
+			positions = offsetPositions(segmentPositions, start, offset)
+			return score + segmentScore, positions
+		}
+
+		for component < fileIndex && !containsFuzzyInsensitive(components[component], segment) {
+			offset += utf8.RuneCountInString(components[component]) + 1
+			component++
+		}
+		if component == fileIndex {
+			return -1, positions
+		}
+		start := len(positions)
+		segmentScore, segmentPositions := scoreFuzzyStrings(components[component], segment, positions)
+		if segmentScore < 0 {
+			return -1, positions[:start]
+		}
+		positions = offsetPositions(segmentPositions, start, offset)
+		score += segmentScore
+		offset += utf8.RuneCountInString(components[component]) + 1
+		component++
+	}
+	return score, positions
+}
+
+// Adds offset to positions[start:], if positions is not nil.
+func offsetPositions(positions []int, start int, offset int) []int {
+	for i := start; i < len(positions); i++ {
+		positions[i] += offset
+	}
+	return positions
+}
@@ -0,0 +1,92 @@
+package grep
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFuzzyQuery(t *testing.T) {
+	q := parseFuzzyQuery("  reindex  grep//fuz src/ / ")
+	expected := []fuzzyTerm{
+		{"reindex", nil, "", false},
+		{"grep//fuz", []string{"grep", "fuz"}, "grepfuz", false},
+		{"src/", []string{"src"}, "src", true},
+	}
+	if !reflect.DeepEqual(expected, q.terms) || q.simple() || q.text() != "reindexgrepfuzsrc" {
+		t.Error("unexpected terms", q.terms)
+	}
+	q = parseFuzzyQuery(" search ")
+	if !q.simple() || q.terms[0].text != "search" {
+		t.Error("expected a simple query", q.terms)
+	}
+}
+
+func TestFuzzyMatchTerms(t *testing.T) {
+	tests := []struct {
+		path      string
+		query     string
+		positions []int
+	}{
+		// all terms must match, in any order
+		{"reindex/search.go", "reindex search", []int{0, 1, 2, 3, 4, 5, 6, 8, 9, 10, 11, 12, 13}},
+		{"reindex/search.go", "search reindex", []int{0, 1, 2, 3, 4, 5, 6, 8, 9, 10, 11, 12, 13}},
+		{"reindex/search.go", "grep search", nil},
+		// overlapping terms
+		{"reindex/search.go", "sea search", []int{8, 9, 10, 11, 12, 13}},
+		// segments match components in order
+		{"grep/fuzzy.go", "grep/fuz", []int{0, 1, 2, 3, 5, 6, 7}},
+		{"fuzzy/grep.go", "grep/fuz", nil},
+		{"a/grep/b/fuzzy/c.go", "grep/fuz", []int{2, 3, 4, 5, 9, 10, 11}},
+		// a segment cannot span components
+		{"gr/ep/fuzzy.go", "grep/fuz", nil},
+		// the last segment prefers the file name
+		{"g/fuz/fuzzy.go", "g/fuz", []int{0, 6, 7, 8}},
+		// trailing slash: directories only
+		{"g/fuz/fuzzy.go", "g/fuz/", []int{0, 2, 3, 4}},
+		{"g/fuzzy.go", "g/fuz/", nil},
+		{"grep/fuzzy.go", "/fuzzy", []int{5, 6, 7, 8, 9}},
+		{"grep/fuzzy.go", "", nil},
+		{"grep/fuzzy.go", "   ", nil},
+	}
+	for _, test := range tests {
+		score, positions := FuzzyMatchPathPositions(test.path, test.query)
+		if (score >= 0) != (test.positions != nil) || !reflect.DeepEqual(positions, test.positions) {
+			t.Errorf("FuzzyMatchPathPositions(%#v, %#v) = %d %v; expected positions %v",
+				test.path, test.query, score, positions, test.positions)
+		}
+	}
+
+	// terms are scored independently
+	both := FuzzyMatchPath("reindex/search.go", "reindex search")
+	if both != FuzzyMatchPath("reindex/search.go", "reindex")+FuzzyMatchPath("reindex/search.go", "search") {
+		t.Error("expected the sum of the term scores", both)
+	}
+	// aligned components score higher than matches within one component
+	if FuzzyMatchPath("grep/fuzzy.go", "grep/fuz") <= FuzzyMatchPath("grepfuzzy/x.go", "grepfuz") {
+		t.Error("expected a higher score for segments")
+	}
+}
+
+func TestIndexedMatcherTerms(t *testing.T) {
+	matcher := IndexedMatcher{Typos: true}
+	for _, p := range []string{"reindex/search.go", "grep/search.go", "reindex/index.go", "reindex/search_test.go"} {
+		matcher.Add(p)
+	}
+	expected := []string{"reindex/search.go", "reindex/search_test.go"}
+	if output := matcher.Match("reindex search", 0); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected results", expected, output)
+	}
+	// typos are only allowed for single terms
+	if output := matcher.Match("reindex serach", 0); len(output) != 0 {
+		t.Error("unexpected typo results", output)
+	}
+	expected = []string{"grep/search.go"}
+	if output := matcher.Match("gr/sea", 0); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected results", expected, output)
+	}
+	// spaces around a single term are ignored, and use the file name pass
+	expected = []string{"reindex/index.go"}
+	if output := matcher.Match(" index ", 1); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected results", expected, output)
+	}
+}
@@ -3,8 +3,14 @@ package grep
 
 import (
 	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"regexp"
+
+	"github.com/evanj/csearch/charset"
 )
 
 type Match struct {
@@ -21,9 +27,34 @@ func Grep(re *regexp.Regexp, path string) ([]*Match, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return grepReader(re, path, f)
+}
+
+// GrepEncoding is like Grep for a file in encoding (see package charset): it converts the file
+// to UTF-8 before matching, so the lines and offsets are in UTF-8.
+func GrepEncoding(re *regexp.Regexp, path string, encoding string) ([]*Match, error) {
+	if encoding == charset.UTF8 {
+		return Grep(re, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err = charset.Decode(data, encoding)
+	if err != nil {
+		return nil, err
+	}
+	return grepReader(re, path, bytes.NewReader(data))
+}
+
+// maxLineLen is the longest line grepReader reads: indexed files can have lines as long as
+// their limits allow (see reindex.TextLimits), which can be longer than bufio's default.
+const maxLineLen = math.MaxInt32
 
+func grepReader(re *regexp.Regexp, path string, r io.Reader) ([]*Match, error) {
 	line := 1
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLen)
 	var matches []*Match
 	for scanner.Scan() {
 		r := re.FindIndex(scanner.Bytes())
@@ -61,6 +61,15 @@ func BenchmarkFuzzyMatcherLimitedShort(b *testing.B) {
 	runBenchmark(b, "a", 50)
 }
 
+// Many matches with a small limit: exercises replacing results in the top K
+func BenchmarkFuzzyMatcherTop10Short(b *testing.B) {
+	runBenchmark(b, "s", 10)
+}
+
+func BenchmarkFuzzyMatcherTop200Short(b *testing.B) {
+	runBenchmark(b, "s", 200)
+}
+
 func BenchmarkIndexedMatcherUnlimitedLong(b *testing.B) {
 	indexedBenchmark(b, "decoder", 0)
 }
@@ -76,3 +85,61 @@ func BenchmarkIndexedMatcherUnlimitedShort(b *testing.B) {
 func BenchmarkIndexedMatcherLimitedShort(b *testing.B) {
 	indexedBenchmark(b, "a", 50)
 }
+
+func shardedBenchmark(b *testing.B, shards int, query string, limit int) int {
+	lines := loadData()
+	sharded := NewShardedMatcher(shards)
+	for _, l := range lines {
+		sharded.Add(l)
+	}
+	b.ResetTimer()
+
+	totalMatches := 0
+	for i := 0; i < b.N; i++ {
+		matches := sharded.Match(query, limit)
+		totalMatches += len(matches)
+	}
+	return totalMatches
+}
+
+func BenchmarkShardedMatcherUnlimitedLong(b *testing.B) {
+	shardedBenchmark(b, 0, "decoder", 0)
+}
+
+func BenchmarkShardedMatcherLimitedLong(b *testing.B) {
+	shardedBenchmark(b, 0, "decoder", 50)
+}
+
+func BenchmarkShardedMatcherUnlimitedShort(b *testing.B) {
+	shardedBenchmark(b, 0, "a", 0)
+}
+
+func BenchmarkShardedMatcherLimitedShort(b *testing.B) {
+	shardedBenchmark(b, 0, "a", 50)
+}
+
+func BenchmarkShardedMatcher4ShardsLimitedLong(b *testing.B) {
+	shardedBenchmark(b, 4, "decoder", 50)
+}
+
+func BenchmarkShardedMatcherTyposLimitedLong(b *testing.B) {
+	lines := loadData()
+	sharded := NewShardedMatcher(0)
+	sharded.Typos = true
+	for _, l := range lines {
+		sharded.Add(l)
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sharded.Match("decdoer", 50)
+	}
+}
+
+func BenchmarkShardedMatcherTermsLimited(b *testing.B) {
+	shardedBenchmark(b, 0, "src/ decoder", 50)
+}
+
+func BenchmarkIndexedMatcherTermsLimited(b *testing.B) {
+	indexedBenchmark(b, "src/ decoder", 50)
+}
@@ -0,0 +1,362 @@
+package grep
+
+import (
+	"math/bits"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ShardedMatcher returns the same results as IndexedMatcher, but splits the paths into
+// shards that are matched in parallel. It precomputes the lowercase form of ASCII paths, and
+// a bitmask of the characters they contain to quickly reject paths that cannot match.
+type ShardedMatcher struct {
+	// See IndexedMatcher.PathBudget and IndexedMatcher.Typos.
+	PathBudget time.Duration
+	Typos      bool
+
+	shards []*matcherShard
+	next   int
+}
+
+// NewShardedMatcher returns a matcher that uses numShards shards. If numShards <= 0, it
+// uses one shard per CPU.
+func NewShardedMatcher(numShards int) *ShardedMatcher {
+	if numShards <= 0 {
+		numShards = runtime.GOMAXPROCS(0)
+	}
+	matcher := &ShardedMatcher{shards: make([]*matcherShard, numShards)}
+	for i := range matcher.shards {
+		matcher.shards[i] = &matcherShard{}
+	}
+	return matcher
+}
+
+// matcherShard stores paths as a struct of arrays, so the prefilter only reads the masks.
+type matcherShard struct {
+	paths []string
+	// lowercase path, or "" if the path is not ASCII and must use the slow path
+	lowerPaths []string
+	// offset of the file name in the path
+	nameOffsets []int32
+	pathMasks   []uint64
+	nameMasks   []uint64
+}
+
+// Bits 0-25 are letters, 26-35 are digits, 36-62 are shared by other ASCII bytes, and 63 is
+// all non-ASCII bytes. Uppercase letters have the same bit as lowercase.
+func charBit(c byte) uint64 {
+	c = asciiToLower(c)
+	switch {
+	case 'a' <= c && c <= 'z':
+		return 1 << (c - 'a')
+	case '0' <= c && c <= '9':
+		return 1 << (26 + c - '0')
+	case c >= utf8.RuneSelf:
+		return 1 << 63
+	}
+	return 1 << (36 + c%27)
+}
+
+func charMask(s string) uint64 {
+	mask := uint64(0)
+	for i := 0; i < len(s); i++ {
+		mask |= charBit(s[i])
+	}
+	return mask
+}
+
+// queryMask is charMask for the lowercase form of the runes in query.
+func queryMask(query string) uint64 {
+	mask := uint64(0)
+	for _, r := range query {
+		r = unicode.ToLower(r)
+		if r < utf8.RuneSelf {
+			mask |= charBit(byte(r))
+		} else {
+			mask |= 1 << 63
+		}
+	}
+	return mask
+}
+
+// Returns true if s contains all the bytes in query in order. Both must already be lowercase.
+func containsLowerFuzzy(s string, query string) bool {
+	qIndex := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == query[qIndex] {
+			qIndex += 1
+			if qIndex == len(query) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (matcher *ShardedMatcher) Add(filepath string) {
+	shard := matcher.shards[matcher.next]
+	matcher.next = (matcher.next + 1) % len(matcher.shards)
+
+	filename := path.Base(filepath)
+	nameOffset := len(filepath) - len(filename)
+	lower := ""
+	// non-ASCII paths match everything: they use the slow path
+	pathMask := ^uint64(0)
+	nameMask := ^uint64(0)
+	if isASCII(filepath) && strings.HasSuffix(filepath, filename) {
+		lower = strings.ToLower(filepath)
+		pathMask = charMask(lower)
+		nameMask = charMask(lower[nameOffset:])
+	} else {
+		nameOffset = -1
+	}
+	shard.paths = append(shard.paths, filepath)
+	shard.lowerPaths = append(shard.lowerPaths, lower)
+	shard.nameOffsets = append(shard.nameOffsets, int32(nameOffset))
+	shard.pathMasks = append(shard.pathMasks, pathMask)
+	shard.nameMasks = append(shard.nameMasks, nameMask)
+}
+
+func (matcher *ShardedMatcher) Len() int {
+	total := 0
+	for _, shard := range matcher.shards {
+		total += len(shard.paths)
+	}
+	return total
+}
+
+type shardQuery struct {
+	query      string
+	lowerQuery string
+	// if false, only non-ASCII paths can use lowerQuery: all paths use the slow path
+	ascii  bool
+	mask   uint64
+	limit  int
+	start  time.Time
+	budget time.Duration
+	// lowerRunes(query) if typos are allowed, or nil
+	typoQuery []rune
+	boosts    map[string]int
+}
+
+func (shard *matcherShard) filename(i int) string {
+	if shard.nameOffsets[i] < 0 {
+		return path.Base(shard.paths[i])
+	}
+	return shard.paths[i][shard.nameOffsets[i]:]
+}
+
+// matchFiles matches file names and boosted paths. It returns which paths matched, and the
+// number of file name matches without boosts.
+func (shard *matcherShard) matchFiles(q *shardQuery, fuzzy *FuzzyMatcher) ([]bool, int) {
+	matched := make([]bool, len(shard.paths))
+	fileMatches := 0
+	for i, mask := range shard.nameMasks {
+		if len(q.boosts) > 0 {
+			if boost, ok := q.boosts[shard.paths[i]]; ok {
+				fuzzy.matchBoosted(shard.paths[i], shard.filename(i), boost, q.typoQuery)
+				matched[i] = true
+				continue
+			}
+		}
+		if q.mask&^mask != 0 {
+			continue
+		}
+		if shard.nameOffsets[i] < 0 || !q.ascii {
+			matched[i] = fuzzy.matchFile(shard.paths[i], shard.filename(i))
+			if matched[i] {
+				fileMatches += 1
+			}
+			continue
+		}
+		offset := shard.nameOffsets[i]
+		lowerFilename := shard.lowerPaths[i][offset:]
+		if !containsLowerFuzzy(lowerFilename, q.lowerQuery) {
+			continue
+		}
+		start, end := indexLowerASCII(lowerFilename, q.lowerQuery)
+		score, _ := scoreFileName(shard.paths[i][offset:], q.query, start, end, nil)
+		if score >= 0 {
+			fuzzy.addResult(shard.paths[i], score)
+			matched[i] = true
+			fileMatches += 1
+		}
+	}
+	return matched, fileMatches
+}
+
+// outOfTime reports whether the query has used up its time budget, when checking path i. It
+// only reads the clock every budgetCheckInterval paths, and never without a budget.
+func (q *shardQuery) outOfTime(i int) bool {
+	return q.budget > 0 && i%budgetCheckInterval == 0 && time.Since(q.start) > q.budget
+}
+
+// matchPaths matches the paths that did not match by file name.
+func (shard *matcherShard) matchPaths(q *shardQuery, fuzzy *FuzzyMatcher, matched []bool) {
+	for i, mask := range shard.pathMasks {
+		if i > 0 && q.outOfTime(i) {
+			// out of time: the results may be missing better path matches
+			return
+		}
+		if matched[i] || q.mask&^mask != 0 {
+			continue
+		}
+		if shard.nameOffsets[i] < 0 || !q.ascii {
+			matched[i] = fuzzy.matchPathAndFile(shard.paths[i], shard.filename(i))
+			continue
+		}
+		if !containsLowerFuzzy(shard.lowerPaths[i], q.lowerQuery) {
+			continue
+		}
+		// the file name did not match: only the path can
+		score, _ := scoreFuzzyStrings(shard.paths[i], q.query, nil)
+		if score >= 0 {
+			fuzzy.addResult(shard.paths[i], score)
+			matched[i] = true
+		}
+	}
+}
+
+// matchTypos matches the paths that did not match exactly with one typo.
+func (shard *matcherShard) matchTypos(q *shardQuery, fuzzy *FuzzyMatcher, matched []bool) {
+	for i, mask := range shard.pathMasks {
+		if q.outOfTime(i) {
+			return
+		}
+		// a typo can only remove one query character from the mask
+		if matched[i] || bits.OnesCount64(q.mask&^mask) > 1 {
+			continue
+		}
+		fuzzy.matchTypo(shard.paths[i], shard.filename(i), q.typoQuery)
+	}
+}
+
+// matchTerms matches queries with several terms or slashes against all paths.
+func (shard *matcherShard) matchTerms(q *shardQuery, fuzzy *FuzzyMatcher) {
+	for i, mask := range shard.pathMasks {
+		if i > 0 && q.outOfTime(i) {
+			return
+		}
+		if boost, ok := q.boosts[shard.paths[i]]; ok {
+			fuzzy.matchBoosted(shard.paths[i], shard.filename(i), boost, nil)
+			continue
+		}
+		if q.mask&^mask != 0 {
+			continue
+		}
+		fuzzy.matchPathAndFile(shard.paths[i], shard.filename(i))
+	}
+}
+
+// parallel runs f for each shard concurrently, and waits for them to finish.
+func (matcher *ShardedMatcher) parallel(f func(i int, shard *matcherShard)) {
+	var wg sync.WaitGroup
+	wg.Add(len(matcher.shards))
+	for i, shard := range matcher.shards {
+		go func(i int, shard *matcherShard) {
+			f(i, shard)
+			wg.Done()
+		}(i, shard)
+	}
+	wg.Wait()
+}
+
+func (matcher *ShardedMatcher) match(query string, limit int, boosts map[string]int) *FuzzyMatcher {
+	start := time.Now()
+	parsed := parseFuzzyQuery(query)
+	fuzzies := make([]*FuzzyMatcher, len(matcher.shards))
+	for i := range fuzzies {
+		fuzzies[i] = &FuzzyMatcher{Query: query, Limit: limit, parsed: &parsed}
+	}
+	if parsed.simple() {
+		matcher.matchSimple(parsed.terms[0].text, limit, boosts, start, fuzzies)
+	} else {
+		// the file names cannot be matched first: match all paths in one pass
+		q := &shardQuery{mask: queryMask(parsed.text()), limit: limit, start: start,
+			budget: matcher.PathBudget, boosts: boosts}
+		matcher.parallel(func(i int, shard *matcherShard) {
+			shard.matchTerms(q, fuzzies[i])
+		})
+	}
+
+	// merge the best matches from each shard: ties are broken deterministically, so this is
+	// the same as matching all paths in one matcher
+	merged := &FuzzyMatcher{Query: query, Limit: limit, parsed: &parsed}
+	totalMatches := 0
+	exactMatches := 0
+	for _, fuzzy := range fuzzies {
+		totalMatches += fuzzy.totalMatches
+		exactMatches += fuzzy.exactMatches
+		for _, result := range fuzzy.results {
+			merged.add(result)
+		}
+	}
+	merged.totalMatches = totalMatches
+	merged.exactMatches = exactMatches
+	return merged
+}
+
+// matchSimple matches a query with one term and no slashes, adding the matches from each
+// shard to fuzzies.
+func (matcher *ShardedMatcher) matchSimple(query string, limit int, boosts map[string]int, start time.Time,
+	fuzzies []*FuzzyMatcher) {
+
+	q := &shardQuery{query: query, lowerQuery: strings.ToLower(query), ascii: isASCII(query),
+		mask: queryMask(query), limit: limit, start: start, budget: matcher.PathBudget, boosts: boosts}
+	if matcher.Typos {
+		q.typoQuery = lowerRunes(query)
+	}
+	matched := make([][]bool, len(matcher.shards))
+	fileMatches := make([]int, len(matcher.shards))
+	matcher.parallel(func(i int, shard *matcherShard) {
+		matched[i], fileMatches[i] = shard.matchFiles(q, fuzzies[i])
+	})
+
+	totalFileMatches := 0
+	for _, n := range fileMatches {
+		totalFileMatches += n
+	}
+	if limit <= 0 || totalFileMatches < limit {
+		// not a full set of file name matches, which score higher than any path match
+		matcher.parallel(func(i int, shard *matcherShard) {
+			shard.matchPaths(q, fuzzies[i], matched[i])
+		})
+	}
+
+	exactMatches := 0
+	for _, fuzzy := range fuzzies {
+		exactMatches += fuzzy.exactMatches
+	}
+	if matcher.Typos && (limit <= 0 || exactMatches < limit) {
+		// typo matches rank below all exact matches
+		matcher.parallel(func(i int, shard *matcherShard) {
+			shard.matchTypos(q, fuzzies[i], matched[i])
+		})
+	}
+}
+
+// Match returns the best limit paths that match query. See IndexedMatcher.Match.
+func (matcher *ShardedMatcher) Match(query string, limit int) []string {
+	return matcher.match(query, limit, nil).Results()
+}
+
+// MatchWithPositions is like Match, but also returns the scores and the matched positions.
+func (matcher *ShardedMatcher) MatchWithPositions(query string, limit int) []FuzzyResult {
+	return matcher.match(query, limit, nil).ResultsWithPositions()
+}
+
+// MatchWithBoosts is like MatchWithPositions, but adds boosts to the scores. See
+// IndexedMatcher.MatchWithBoosts.
+func (matcher *ShardedMatcher) MatchWithBoosts(query string, limit int, boosts map[string]int) []FuzzyResult {
+	return matcher.match(query, limit, boosts).ResultsWithPositions()
+}
+
+// MatchResults returns the matcher with the results. See IndexedMatcher.MatchResults.
+func (matcher *ShardedMatcher) MatchResults(query string, limit int, boosts map[string]int) *FuzzyMatcher {
+	return matcher.match(query, limit, boosts)
+}
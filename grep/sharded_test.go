@@ -0,0 +1,80 @@
+package grep
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShardedMatcherSameAsIndexed(t *testing.T) {
+	paths := loadData()
+	// non-ASCII paths use the slow path
+	paths = append(paths, "src/ünïcode/Decoder.go", "docs/été/a.txt", "ßtraße/decoder",
+		"x/\u0130stanbul.go", "\u212aey/key.go", "bad\xff/na\xffme.go")
+
+	indexed := &IndexedMatcher{}
+	for _, p := range paths {
+		indexed.Add(p)
+	}
+	typoQueries := []string{"serach", "decdoer", "ecoel", "\u212aey/kye"}
+	for _, shards := range []int{1, 3, 0} {
+		sharded := NewShardedMatcher(shards)
+		for _, p := range paths {
+			sharded.Add(p)
+		}
+		if sharded.Len() != len(paths) {
+			t.Error("wrong length", sharded.Len())
+		}
+
+		for _, query := range []string{"a", "decoder", "DeCoDeR", "src/go", "ü", "été", "zzzzzz", "_test.go",
+			"istanbul", "\u212aey", "KEY", "name", "\xff",
+			"grep/fuz", "src/ go", "decoder test", " a ", "/", "image/ png"} {
+			for _, limit := range []int{0, 1, 10, 200} {
+				expected := indexed.match(query, limit, nil)
+				output := sharded.match(query, limit, nil)
+				if !reflect.DeepEqual(expected.ResultsWithPositions(), output.ResultsWithPositions()) {
+					t.Errorf("shards=%d query=%#v limit=%d: results differ", shards, query, limit)
+				}
+				if expected.TotalMatches() != output.TotalMatches() {
+					t.Errorf("shards=%d query=%#v limit=%d: total %d != %d",
+						shards, query, limit, expected.TotalMatches(), output.TotalMatches())
+				}
+			}
+		}
+
+		indexed.Typos = true
+		sharded.Typos = true
+		for _, query := range append(typoQueries, "decoder", "a") {
+			for _, limit := range []int{1, 10, 200} {
+				expected := indexed.MatchWithPositions(query, limit)
+				output := sharded.MatchWithPositions(query, limit)
+				if !reflect.DeepEqual(expected, output) {
+					t.Errorf("typos shards=%d query=%#v limit=%d: results differ", shards, query, limit)
+				}
+			}
+		}
+
+		boosts := map[string]int{paths[0]: 1000, paths[10]: 50, paths[len(paths)-1]: 10, "missing": 1}
+		for _, query := range append(typoQueries, "decoder", "a") {
+			for _, limit := range []int{1, 10, 200} {
+				expected := indexed.MatchWithBoosts(query, limit, boosts)
+				output := sharded.MatchWithBoosts(query, limit, boosts)
+				if !reflect.DeepEqual(expected, output) {
+					t.Errorf("boosts shards=%d query=%#v limit=%d: results differ", shards, query, limit)
+				}
+			}
+		}
+		indexed.Typos = false
+	}
+}
+
+func TestCharMask(t *testing.T) {
+	if charMask("ABC") != charMask("cba") {
+		t.Error("masks must be case insensitive")
+	}
+	if charMask("abc")&^charMask("xaybzc") != 0 {
+		t.Error("subsequence must be a subset")
+	}
+	if charMask("é")&^charMask("abcdefghijklmnopqrstuvwxyz0123456789./_-") == 0 {
+		t.Error("non-ASCII must not match ASCII")
+	}
+}
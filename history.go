@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/evanj/csearch/history"
+)
+
+// Saves the search in the form values q and f with name, then redirects to the results.
+func (server *csearchServer) saveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		panic(err)
+	}
+	q := history.Query{Query: r.Form.Get("q"), FileFilter: r.Form.Get("f")}
+	err = server.history.Save(r.Form.Get("name"), q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, searchURL(q.Query, q.FileFilter), http.StatusSeeOther)
+}
+
+type jsonHistoryResponse struct {
+	Recent []history.Recent `json:"recent"`
+	Saved  []history.Saved  `json:"saved"`
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the recent and saved queries.
+func (server *csearchServer) apiHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, jsonHistoryResponse{server.history.Recent(), server.history.Saved()})
+}
+
+// GET lists the saved queries. POST saves the query with parameters name, q and f, replacing
+// any with the same name. DELETE removes the query with parameter name.
+func (server *csearchServer) apiSavedHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.Form.Get("name")
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, server.history.Saved())
+	case "POST":
+		err = server.history.Save(name, history.Query{Query: r.Form.Get("q"), FileFilter: r.Form.Get("f")})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, server.history.Saved())
+	case "DELETE":
+		deleted, err := server.history.Delete(name)
+		if err != nil {
+			panic(err)
+		}
+		if !deleted {
+			http.Error(w, "saved query not found: "+name, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, server.history.Saved())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
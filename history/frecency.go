@@ -0,0 +1,114 @@
+package history
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Each use of a file counts half as much after this long
+const frecencyHalfLife = 7 * 24 * time.Hour
+
+// Maximum number of files to remember; the lowest scores are forgotten first
+const maxFrecencyFiles = 1000
+
+type frecencyEntry struct {
+	Path string `json:"path"`
+	// Score at Time: each use adds 1, and it decays with frecencyHalfLife
+	Score float64   `json:"score"`
+	Time  time.Time `json:"time"`
+}
+
+func (e *frecencyEntry) scoreAt(t time.Time) float64 {
+	return e.Score * math.Exp2(-t.Sub(e.Time).Hours()/frecencyHalfLife.Hours())
+}
+
+// Frecency counts how frequently and recently files were used, persisted in a JSON file. It is
+// safe to use from multiple goroutines.
+type Frecency struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*frecencyEntry
+}
+
+// OpenFrecency reads the file at path. If it does not exist, it is created on the first use.
+func OpenFrecency(path string) (*Frecency, error) {
+	f := &Frecency{path: path, entries: map[string]*frecencyEntry{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, err
+	}
+	var entries []*frecencyEntry
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		f.entries[e.Path] = e
+	}
+	return f, nil
+}
+
+// Use records that path was used at t.
+func (f *Frecency) Use(path string, t time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e := f.entries[path]
+	if e == nil {
+		e = &frecencyEntry{Path: path}
+		f.entries[path] = e
+	}
+	e.Score = e.scoreAt(t) + 1
+	e.Time = t
+
+	entries := f.sorted(t)
+	if len(entries) > maxFrecencyFiles {
+		for _, e := range entries[maxFrecencyFiles:] {
+			delete(f.entries, e.Path)
+		}
+		entries = entries[:maxFrecencyFiles]
+	}
+	return writeJSONFile(f.path, entries)
+}
+
+// sorted must be called with mu held. It returns the entries with the highest score at t first.
+func (f *Frecency) sorted(t time.Time) []*frecencyEntry {
+	entries := make([]*frecencyEntry, 0, len(f.entries))
+	scores := map[*frecencyEntry]float64{}
+	for _, e := range f.entries {
+		entries = append(entries, e)
+		scores[e] = e.scoreAt(t)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if scores[entries[i]] != scores[entries[j]] {
+			return scores[entries[i]] > scores[entries[j]]
+		}
+		return entries[i].Path < entries[j].Path
+	})
+	return entries
+}
+
+// Boosts returns a ranking boost between 0 and maxBoost for each file used before t. A file
+// used once at t gets half of maxBoost; more uses approach maxBoost, and older uses count less.
+func (f *Frecency) Boosts(t time.Time, maxBoost int) map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	boosts := map[string]int{}
+	for path, e := range f.entries {
+		score := e.scoreAt(t)
+		boost := int(float64(maxBoost) * score / (score + 1))
+		if boost > 0 {
+			boosts[path] = boost
+		}
+	}
+	return boosts
+}
@@ -0,0 +1,84 @@
+package history
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFrecency(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "frecency_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "frecency.json")
+
+	f, err := OpenFrecency(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	if len(f.Boosts(now, 100)) != 0 {
+		t.Error("new frecency must be empty")
+	}
+
+	uses := []struct {
+		path string
+		t    time.Time
+	}{
+		{"often.go", now.Add(-time.Hour)},
+		{"often.go", now.Add(-time.Minute)},
+		{"often.go", now},
+		{"once.go", now},
+		{"old.go", now.Add(-frecencyHalfLife)},
+		{"ancient.go", now.Add(-20 * frecencyHalfLife)},
+	}
+	for _, use := range uses {
+		err = f.Use(use.path, use.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// once: score 1 -> 1/2; old: score 1/2 -> 1/3; ancient: rounds to 0
+	expected := map[string]int{"often.go": 74, "once.go": 50, "old.go": 33}
+	if boosts := f.Boosts(now, 100); !reflect.DeepEqual(expected, boosts) {
+		t.Error("unexpected boosts", expected, boosts)
+	}
+
+	reopened, err := OpenFrecency(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if boosts := reopened.Boosts(now, 100); !reflect.DeepEqual(expected, boosts) {
+		t.Error("frecency did not persist", boosts)
+	}
+}
+
+func TestMaxFrecencyFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "frecency_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	f, err := OpenFrecency(filepath.Join(tempDir, "frecency.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < maxFrecencyFiles+10; i++ {
+		err = f.Use(fmt.Sprintf("%d.go", i), start.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	boosts := f.Boosts(start.Add(time.Duration(maxFrecencyFiles+10)*time.Minute), 1000)
+	if _, exists := boosts["0.go"]; len(boosts) != maxFrecencyFiles || exists {
+		t.Error("oldest files must be forgotten", len(boosts))
+	}
+}
@@ -0,0 +1,180 @@
+// Package history stores recent and saved search queries in a file
+package history
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/evanj/csearch/atomicfile"
+)
+
+// Maximum number of recent queries to keep
+const maxRecent = 50
+
+// How long AddRecent waits before writing the file, so a burst of searches writes it once.
+// Tests change it.
+var recentWriteDelay = 5 * time.Second
+
+// Query is a search: the same parameters as the /search page.
+type Query struct {
+	Query      string `json:"query"`
+	FileFilter string `json:"file_filter"`
+}
+
+// Recent is a query that was run.
+type Recent struct {
+	Query
+	Time time.Time `json:"time"`
+}
+
+// Saved is a query that was given a name.
+type Saved struct {
+	Query
+	Name string `json:"name"`
+}
+
+type storeData struct {
+	Recent []Recent `json:"recent"`
+	Saved  []Saved  `json:"saved"`
+}
+
+// Store is a set of recent and saved queries, persisted in a JSON file. It is safe to use
+// from multiple goroutines.
+type Store struct {
+	path string
+	mu   sync.Mutex
+	data storeData
+	// a write of recent queries is scheduled
+	pending bool
+}
+
+// Open reads the store at path. If the file does not exist, the store is empty and the file
+// is created on the first change.
+func Open(path string) (*Store, error) {
+	store := &Store{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &store.data)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// write must be called with mu held.
+func (s *Store) write() error {
+	s.pending = false
+	return writeJSONFile(s.path, &s.data)
+}
+
+// writeRecent writes the recent queries added since the last write, if any.
+func (s *Store) writeRecent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.pending {
+		return
+	}
+	err := s.write()
+	if err != nil {
+		log.Printf("failed to record recent queries: %s", err)
+	}
+}
+
+// Flush writes the recent queries added since the last write, if any.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.pending {
+		return nil
+	}
+	return s.write()
+}
+
+// writeJSONFile replaces the file at path atomically with value encoded as JSON, so a crash
+// does not lose the previous contents.
+func writeJSONFile(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data)
+}
+
+// AddRecent records that q was run at t. If q was run before, it is moved to the front. Recent
+// queries are best-effort: they are written in the background after recentWriteDelay, or by
+// Flush, Save or Delete, and write errors are logged.
+func (s *Store) AddRecent(q Query, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recent := []Recent{{q, t}}
+	for _, r := range s.data.Recent {
+		if r.Query != q && len(recent) < maxRecent {
+			recent = append(recent, r)
+		}
+	}
+	s.data.Recent = recent
+	if !s.pending {
+		s.pending = true
+		time.AfterFunc(recentWriteDelay, s.writeRecent)
+	}
+}
+
+// Recent returns the recently run queries, most recent first.
+func (s *Store) Recent() []Recent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Recent(nil), s.data.Recent...)
+}
+
+// Save stores q with name, replacing any query with the same name.
+func (s *Store) Save(name string, q Query) error {
+	if name == "" {
+		return errors.New("saved queries must have a name")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	saved := Saved{q, name}
+	i := sort.Search(len(s.data.Saved), func(i int) bool { return s.data.Saved[i].Name >= name })
+	if i < len(s.data.Saved) && s.data.Saved[i].Name == name {
+		s.data.Saved[i] = saved
+	} else {
+		s.data.Saved = append(s.data.Saved, Saved{})
+		copy(s.data.Saved[i+1:], s.data.Saved[i:])
+		s.data.Saved[i] = saved
+	}
+	return s.write()
+}
+
+// Delete removes the saved query with name. It returns false if it does not exist.
+func (s *Store) Delete(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, saved := range s.data.Saved {
+		if saved.Name == name {
+			s.data.Saved = append(s.data.Saved[:i], s.data.Saved[i+1:]...)
+			return true, s.write()
+		}
+	}
+	return false, nil
+}
+
+// Saved returns the saved queries, sorted by name.
+func (s *Store) Saved() []Saved {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Saved(nil), s.data.Saved...)
+}
@@ -0,0 +1,141 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "history.json")
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Recent()) != 0 || len(store.Saved()) != 0 {
+		t.Error("new store must be empty")
+	}
+
+	start := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	queries := []Query{{"foo", ""}, {"bar", "\\.go$"}, {"foo", ""}}
+	for i, q := range queries {
+		store.AddRecent(q, start.Add(time.Duration(i)*time.Second))
+	}
+	expectedRecent := []Recent{{queries[2], start.Add(2 * time.Second)}, {queries[1], start.Add(time.Second)}}
+	if !reflect.DeepEqual(store.Recent(), expectedRecent) {
+		t.Error("unexpected recent queries", store.Recent())
+	}
+
+	for _, name := range []string{"todos", "all", "todos"} {
+		err = store.Save(name, Query{"TODO\\(" + name + "\\)", ""})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.Save("", Query{}); err == nil {
+		t.Error("expected error for empty name")
+	}
+	expectedSaved := []Saved{{Query{"TODO\\(all\\)", ""}, "all"}, {Query{"TODO\\(todos\\)", ""}, "todos"}}
+	if !reflect.DeepEqual(store.Saved(), expectedSaved) {
+		t.Error("unexpected saved queries", store.Saved())
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.Recent(), expectedRecent) || !reflect.DeepEqual(reopened.Saved(), expectedSaved) {
+		t.Error("store did not persist", reopened.Recent(), reopened.Saved())
+	}
+
+	deleted, err := store.Delete("all")
+	if !deleted || err != nil {
+		t.Error("delete failed", deleted, err)
+	}
+	deleted, err = store.Delete("all")
+	if deleted || err != nil {
+		t.Error("delete of missing query must return false", deleted, err)
+	}
+	if !reflect.DeepEqual(store.Saved(), expectedSaved[1:]) {
+		t.Error("unexpected saved queries", store.Saved())
+	}
+}
+
+func TestMaxRecent(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store, err := Open(filepath.Join(tempDir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxRecent+10; i++ {
+		store.AddRecent(Query{string(rune('a' + i)), ""}, time.Now())
+	}
+	recent := store.Recent()
+	if len(recent) != maxRecent || recent[0].Query.Query != string(rune('a'+maxRecent+9)) {
+		t.Error("unexpected recent queries", recent)
+	}
+}
+
+func TestAddRecentDelayed(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "history_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "history.json")
+
+	defer func(delay time.Duration) { recentWriteDelay = delay }(recentWriteDelay)
+	recentWriteDelay = time.Hour
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := Query{"foo", ""}
+	store.AddRecent(q, time.Now())
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Error("AddRecent must not write the file immediately", err)
+	}
+	err = store.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.Recent()) != 1 || reopened.Recent()[0].Query != q {
+		t.Error("Flush did not write recent queries", reopened.Recent())
+	}
+
+	// the background write
+	recentWriteDelay = time.Millisecond
+	q2 := Query{"bar", ""}
+	store.AddRecent(q2, time.Now())
+	for i := 0; i < 100; i++ {
+		reopened, err = Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reopened.Recent()) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(reopened.Recent()) != 2 || reopened.Recent()[0].Query != q2 {
+		t.Error("recent queries were not written in the background", reopened.Recent())
+	}
+}
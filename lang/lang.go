@@ -0,0 +1,181 @@
+// Package lang classifies source files by programming language
+package lang
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"strings"
+)
+
+// Language names returned by Detect. Unknown files are classified as the empty string.
+const (
+	Bazel      = "bazel"
+	C          = "c"
+	CMake      = "cmake"
+	Cpp        = "c++"
+	CSharp     = "c#"
+	CSS        = "css"
+	Docker     = "docker"
+	Go         = "go"
+	HTML       = "html"
+	Java       = "java"
+	JavaScript = "javascript"
+	JSON       = "json"
+	Make       = "make"
+	Markdown   = "markdown"
+	ObjectiveC = "objective-c"
+	Perl       = "perl"
+	PHP        = "php"
+	Proto      = "proto"
+	Python     = "python"
+	Ruby       = "ruby"
+	Rust       = "rust"
+	Scala      = "scala"
+	Shell      = "shell"
+	SQL        = "sql"
+	Swift      = "swift"
+	Thrift     = "thrift"
+	TypeScript = "typescript"
+	XML        = "xml"
+	YAML       = "yaml"
+)
+
+var byFilename = map[string]string{
+	"BUILD":          Bazel,
+	"BUILD.bazel":    Bazel,
+	"WORKSPACE":      Bazel,
+	"CMakeLists.txt": CMake,
+	"Dockerfile":     Docker,
+	"GNUmakefile":    Make,
+	"Makefile":       Make,
+	"makefile":       Make,
+	"Gemfile":        Ruby,
+	"Rakefile":       Ruby,
+}
+
+var byExtension = map[string]string{
+	".bzl":    Bazel,
+	".c":      C,
+	".h":      C,
+	".cmake":  CMake,
+	".cc":     Cpp,
+	".cpp":    Cpp,
+	".cxx":    Cpp,
+	".hh":     Cpp,
+	".hpp":    Cpp,
+	".cs":     CSharp,
+	".css":    CSS,
+	".go":     Go,
+	".htm":    HTML,
+	".html":   HTML,
+	".java":   Java,
+	".js":     JavaScript,
+	".jsx":    JavaScript,
+	".mjs":    JavaScript,
+	".json":   JSON,
+	".mk":     Make,
+	".md":     Markdown,
+	".m":      ObjectiveC,
+	".mm":     ObjectiveC,
+	".pl":     Perl,
+	".pm":     Perl,
+	".php":    PHP,
+	".proto":  Proto,
+	".py":     Python,
+	".rb":     Ruby,
+	".rs":     Rust,
+	".scala":  Scala,
+	".bash":   Shell,
+	".sh":     Shell,
+	".zsh":    Shell,
+	".sql":    SQL,
+	".swift":  Swift,
+	".thrift": Thrift,
+	".ts":     TypeScript,
+	".tsx":    TypeScript,
+	".xml":    XML,
+	".yaml":   YAML,
+	".yml":    YAML,
+}
+
+// interpreters named in #! lines, after removing version numbers (python2.7 -> python)
+var byInterpreter = map[string]string{
+	"bash":   Shell,
+	"dash":   Shell,
+	"ksh":    Shell,
+	"sh":     Shell,
+	"zsh":    Shell,
+	"node":   JavaScript,
+	"perl":   Perl,
+	"php":    PHP,
+	"python": Python,
+	"ruby":   Ruby,
+}
+
+// Number of bytes Detect needs to see from the start of a file
+const headLen = 256
+
+// DetectPath returns the language of filepath using only its name, or "" if the name is not
+// enough to tell.
+func DetectPath(filepath string) string {
+	filename := path.Base(filepath)
+	if l, ok := byFilename[filename]; ok {
+		return l
+	}
+	return byExtension[strings.ToLower(path.Ext(filename))]
+}
+
+// DetectShebang returns the language of the interpreter named in a #! line at the start of
+// head, or "" if there is none.
+func DetectShebang(head []byte) string {
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return ""
+	}
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return ""
+	}
+	interpreter := path.Base(fields[0])
+	if interpreter == "env" {
+		// #!/usr/bin/env [-S] python3
+		interpreter = ""
+		for _, arg := range fields[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+				interpreter = arg
+				break
+			}
+		}
+	}
+	interpreter = strings.TrimRight(interpreter, "0123456789.")
+	return byInterpreter[interpreter]
+}
+
+// Detect returns the language of the file at filepath, which begins with head. It uses the
+// file name, then the #! line.
+func Detect(filepath string, head []byte) string {
+	if l := DetectPath(filepath); l != "" {
+		return l
+	}
+	return DetectShebang(head)
+}
+
+// DetectFile is like Detect, but only reads the beginning of the file if the name is not
+// enough. It returns "" if the file cannot be read.
+func DetectFile(filepath string) string {
+	if l := DetectPath(filepath); l != "" {
+		return l
+	}
+	f, err := os.Open(filepath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	head := make([]byte, headLen)
+	n, _ := f.Read(head)
+	return DetectShebang(head[:n])
+}
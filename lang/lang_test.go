@@ -0,0 +1,59 @@
+package lang
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		path     string
+		head     string
+		expected string
+	}{
+		{"a/b/search.go", "", Go},
+		{"a/b/Search.JAVA", "", Java},
+		{"a/Makefile", "", Make},
+		{"a/BUILD", "", Bazel},
+		{"a/build", "", ""},
+		{"x.h", "", C},
+		{"script", "#!/bin/sh\necho", Shell},
+		{"script", "#!/usr/bin/env python3\nimport os", Python},
+		{"script", "#!/usr/bin/env -S ruby -w\n", Ruby},
+		{"script", "#!/usr/bin/python2.7", Python},
+		{"script", "#! /usr/bin/perl -w", Perl},
+		{"script", "#!/usr/bin/env", ""},
+		{"script", "#!", ""},
+		{"script", "echo hello", ""},
+		// the name wins
+		{"script.rb", "#!/bin/sh", Ruby},
+	}
+	for _, test := range tests {
+		output := Detect(test.path, []byte(test.head))
+		if output != test.expected {
+			t.Errorf("Detect(%#v, %#v)=%#v; expected %#v", test.path, test.head, output, test.expected)
+		}
+	}
+}
+
+func TestDetectFile(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "lang_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "script")
+	err = ioutil.WriteFile(path, []byte("#!/bin/bash\nexit 0\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := DetectFile(path); l != Shell {
+		t.Error("expected shell", l)
+	}
+	if l := DetectFile(filepath.Join(tempDir, "doesnotexist")); l != "" {
+		t.Error("expected unknown", l)
+	}
+}
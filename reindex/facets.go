@@ -0,0 +1,56 @@
+package reindex
+
+import (
+	"path"
+	"sort"
+)
+
+// FacetCount is the number of files with a value of a property, such as a language.
+type FacetCount struct {
+	Value string `json:"value"`
+	Files int    `json:"files"`
+}
+
+// Facets counts the distinct files in a set of results by the properties that a Filter can
+// restrict. Each list is sorted with the most common value first.
+type Facets struct {
+	Dirs  []FacetCount `json:"dirs"`
+	Exts  []FacetCount `json:"exts"`
+	Langs []FacetCount `json:"langs"`
+	Roots []FacetCount `json:"roots"`
+}
+
+// CountFacets returns the facets of results, which must be from ix.
+func CountFacets(ix Searcher, results []*Result) *Facets {
+	files := map[string]string{}
+	for _, r := range results {
+		files[r.Path] = r.Lang
+	}
+
+	dirs := map[string]int{}
+	exts := map[string]int{}
+	langs := map[string]int{}
+	roots := map[string]int{}
+	for filepath, lang := range files {
+		root := ix.Root(filepath)
+		dirs[topDir(root, filepath)] += 1
+		exts[path.Ext(filepath)] += 1
+		langs[lang] += 1
+		roots[root] += 1
+	}
+	return &Facets{sortCounts(dirs), sortCounts(exts), sortCounts(langs), sortCounts(roots)}
+}
+
+func sortCounts(counts map[string]int) []FacetCount {
+	out := make([]FacetCount, 0, len(counts))
+	for value, files := range counts {
+		out = append(out, FacetCount{value, files})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Files != out[j].Files {
+			return out[i].Files > out[j].Files
+		}
+		return out[i].Value < out[j].Value
+	})
+	return out
+}
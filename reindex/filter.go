@@ -0,0 +1,175 @@
+package reindex
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter restricts the files that are searched. Each list that is not empty restricts files
+// to those matching one of its values.
+type Filter struct {
+	// Regexp that paths must match. The empty string matches all paths.
+	File string
+	// Languages (see package lang). "" matches files with unknown languages.
+	Langs []string
+	// Top-level directories below the indexed root. "" matches files directly in the root.
+	Dirs []string
+	// File extensions, including the dot. "" matches files without an extension.
+	Exts []string
+	// Indexed roots (the paths passed to IndexTree).
+	Roots []string
+}
+
+type compiledFilter struct {
+	ix    Searcher
+	file  *regexp.Regexp
+	langs map[string]struct{}
+	dirs  map[string]struct{}
+	exts  map[string]struct{}
+	roots map[string]struct{}
+}
+
+func toSet(values []string) map[string]struct{} {
+	if len(values) == 0 {
+		return nil
+	}
+	set := map[string]struct{}{}
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func (filter Filter) compile(ix Searcher) (*compiledFilter, error) {
+	fileRe, err := regexp.Compile(filter.File)
+	if err != nil {
+		return nil, err
+	}
+	return &compiledFilter{ix, fileRe, toSet(filter.Langs), toSet(filter.Dirs),
+		toSet(filter.Exts), toSet(filter.Roots)}, nil
+}
+
+func contains(set map[string]struct{}, value string) bool {
+	if set == nil {
+		return true
+	}
+	_, ok := set[value]
+	return ok
+}
+
+func (filter *compiledFilter) match(filepath string, lang string) bool {
+	if !contains(filter.langs, lang) || !contains(filter.exts, path.Ext(filepath)) {
+		return false
+	}
+	if filter.dirs != nil || filter.roots != nil {
+		root := filter.ix.Root(filepath)
+		if !contains(filter.roots, root) || !contains(filter.dirs, topDir(root, filepath)) {
+			return false
+		}
+	}
+	return filter.file.MatchString(filepath)
+}
+
+// topDir returns the first directory in filepath below root, or "" for files directly in root.
+func topDir(root string, filepath string) string {
+	rel := strings.TrimPrefix(filepath[len(root):], "/")
+	i := strings.IndexByte(rel, '/')
+	if i < 0 {
+		return ""
+	}
+	return rel[:i]
+}
+
+// Prefixes of the terms in a query that restrict the files searched.
+const (
+	langQueryPrefix = "lang:"
+	dirQueryPrefix  = "dir:"
+	extQueryPrefix  = "ext:"
+	rootQueryPrefix = "root:"
+)
+
+func (filter *Filter) termValues(term string) (*[]string, string) {
+	switch {
+	case strings.HasPrefix(term, langQueryPrefix):
+		return &filter.Langs, term[len(langQueryPrefix):]
+	case strings.HasPrefix(term, dirQueryPrefix):
+		return &filter.Dirs, term[len(dirQueryPrefix):]
+	case strings.HasPrefix(term, extQueryPrefix):
+		return &filter.Exts, term[len(extQueryPrefix):]
+	case strings.HasPrefix(term, rootQueryPrefix):
+		return &filter.Roots, term[len(rootQueryPrefix):]
+	}
+	return nil, ""
+}
+
+// ParseQuery removes the filter terms from the start of a query such as
+// "lang:go lang:c dir:src foo", and returns the rest of the query and the filter. Values with
+// spaces are quoted like Go strings, e.g. root:"/src/my project". The File field of the filter
+// is not set.
+func ParseQuery(q string) (string, Filter) {
+	var filter Filter
+	for {
+		values, value := filter.termValues(q)
+		if values == nil {
+			return q, filter
+		}
+		value, rest, ok := splitTermValue(value)
+		if !ok {
+			return q, filter
+		}
+		*values = append(*values, value)
+		q = strings.TrimLeft(rest, " ")
+	}
+}
+
+// splitTermValue splits the value of a filter term from the rest of the query: the value ends
+// at the first space, unless it is quoted. It returns false if a quoted value is invalid or is
+// not followed by a space.
+func splitTermValue(s string) (string, string, bool) {
+	if !strings.HasPrefix(s, `"`) {
+		if i := strings.IndexByte(s, ' '); i >= 0 {
+			return s[:i], s[i:], true
+		}
+		return s, "", true
+	}
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", false
+	}
+	rest := s[len(quoted):]
+	if rest != "" && rest[0] != ' ' {
+		return "", "", false
+	}
+	value, err := strconv.Unquote(quoted)
+	return value, rest, err == nil
+}
+
+// formatTermValue quotes value if ParseQuery would not parse it unquoted.
+func formatTermValue(value string) string {
+	if strings.ContainsRune(value, ' ') || strings.HasPrefix(value, `"`) {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// FormatQuery returns a query that ParseQuery parses to pattern and filter.
+func FormatQuery(pattern string, filter Filter) string {
+	var terms []string
+	for _, list := range []struct {
+		prefix string
+		values []string
+	}{
+		{langQueryPrefix, filter.Langs},
+		{dirQueryPrefix, filter.Dirs},
+		{extQueryPrefix, filter.Exts},
+		{rootQueryPrefix, filter.Roots},
+	} {
+		for _, v := range list.values {
+			terms = append(terms, list.prefix+formatTermValue(v))
+		}
+	}
+	terms = append(terms, pattern)
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,257 @@
+package reindex
+
+import (
+	"bytes"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanj/csearch/charset"
+	"github.com/evanj/csearch/grep"
+	"github.com/evanj/csearch/lang"
+	"github.com/google/codesearch/index"
+)
+
+// Kinds of identifiers that SearchIdent can restrict matches to.
+const (
+	IdentAny    = ""
+	IdentFunc   = "func"
+	IdentType   = "type"
+	IdentField  = "field"
+	IdentImport = "import"
+)
+
+var identKinds = map[string]struct{}{
+	IdentFunc: {}, IdentType: {}, IdentField: {}, IdentImport: {},
+}
+
+// ParseIdentQuery splits an identifier query of the form "name" or "kind:name".
+func ParseIdentQuery(q string) (kind string, name string, err error) {
+	name = q
+	if i := strings.IndexByte(q, ':'); i >= 0 {
+		kind = q[:i]
+		name = q[i+1:]
+		if _, ok := identKinds[kind]; !ok {
+			return "", "", errors.New("unknown identifier kind: " + kind)
+		}
+	}
+	if name == "" {
+		return "", "", errors.New("empty identifier")
+	}
+	return kind, name, nil
+}
+
+// Returns matches for Go identifiers named name, in files that match filter. If kind is
+// not IdentAny, only identifiers used as that kind match: function declarations and calls,
+// type declarations and uses, struct fields and selectors, or import paths. Unlike Search,
+// matches in comments and strings, or that are part of a longer identifier, are excluded.
+func SearchIdent(ix *Index, kind string, name string, filter Filter) ([]*Result, error) {
+	start := time.Now()
+
+	if len(name) < minQueryLength {
+		return nil, errors.New("query string too short")
+	}
+	if _, ok := identKinds[kind]; !ok && kind != IdentAny {
+		return nil, errors.New("unknown identifier kind: " + kind)
+	}
+	qSyntax, err := syntax.Parse(regexp.QuoteMeta(name), syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	compiledFilter, err := filter.compile(ix)
+	if err != nil {
+		return nil, err
+	}
+
+	postingList := ix.PostingQuery(index.RegexpQuery(qSyntax))
+	postingTime := time.Now()
+
+	goFiles := 0
+	var results []*Result
+	for _, fileId := range postingList {
+		path := ix.Name(fileId)
+		if ix.Lang(fileId) != lang.Go || !compiledFilter.match(path, lang.Go) {
+			continue
+		}
+		goFiles += 1
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		data, err = charset.Decode(data, ix.Encoding(fileId))
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range grepIdent(path, data, kind, name) {
+			results = append(results, &Result{match, lang.Go})
+		}
+	}
+	grepTime := time.Now()
+	log.Printf("ident posting matches: %d; go files: %d; matches: %d",
+		len(postingList), goFiles, len(results))
+	log.Printf("posting time: %f parse time: %f",
+		postingTime.Sub(start).Seconds(), grepTime.Sub(postingTime).Seconds())
+	return results, nil
+}
+
+// grepIdent returns the identifiers in the Go source data that match kind and name. It
+// returns nothing if data does not parse.
+func grepIdent(path string, data []byte, kind string, name string) []*grep.Match {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, data, parser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	var results []*grep.Match
+	addMatch := func(pos token.Pos, length int) {
+		p := fset.PositionFor(pos, false)
+		start := p.Column - 1
+		results = append(results, &grep.Match{
+			Path: path, LineNumber: p.Line, Line: string(lines[p.Line-1]), Start: start, End: start + length})
+	}
+
+	if kind == IdentImport {
+		for _, spec := range f.Imports {
+			importPath, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				continue
+			}
+			if importPath == name || strings.HasSuffix(importPath, "/"+name) {
+				addMatch(spec.Path.Pos(), len(spec.Path.Value))
+			}
+		}
+		return results
+	}
+
+	kinds := classifyIdents(f)
+	ast.Inspect(f, func(n ast.Node) bool {
+		ident, ok := n.(*ast.Ident)
+		if !ok || ident.Name != name {
+			return true
+		}
+		if kind == IdentAny || kinds[ident] == kind {
+			addMatch(ident.Pos(), len(ident.Name))
+		}
+		return true
+	})
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].LineNumber != results[j].LineNumber {
+			return results[i].LineNumber < results[j].LineNumber
+		}
+		return results[i].Start < results[j].Start
+	})
+	return results
+}
+
+// classifyIdents returns the kind of each identifier in f that is used as a function, type
+// or field. This is purely syntactic: conversions look like calls, and selectors of package
+// level variables look like fields.
+func classifyIdents(f *ast.File) map[*ast.Ident]string {
+	kinds := map[*ast.Ident]string{}
+	var markType func(expr ast.Expr)
+	markType = func(expr ast.Expr) {
+		switch e := expr.(type) {
+		case *ast.Ident:
+			kinds[e] = IdentType
+		case *ast.SelectorExpr:
+			kinds[e.Sel] = IdentType
+		case *ast.StarExpr:
+			markType(e.X)
+		case *ast.ParenExpr:
+			markType(e.X)
+		case *ast.ArrayType:
+			markType(e.Elt)
+		case *ast.MapType:
+			markType(e.Key)
+			markType(e.Value)
+		case *ast.ChanType:
+			markType(e.Value)
+		case *ast.Ellipsis:
+			markType(e.Elt)
+		case *ast.IndexExpr:
+			markType(e.X)
+			markType(e.Index)
+		case *ast.IndexListExpr:
+			markType(e.X)
+			for _, index := range e.Indices {
+				markType(index)
+			}
+		}
+	}
+	markFunc := func(expr ast.Expr) {
+		for {
+			switch e := expr.(type) {
+			case *ast.IndexExpr:
+				expr = e.X
+				continue
+			case *ast.IndexListExpr:
+				expr = e.X
+				continue
+			case *ast.ParenExpr:
+				expr = e.X
+				continue
+			case *ast.Ident:
+				kinds[e] = IdentFunc
+			case *ast.SelectorExpr:
+				kinds[e.Sel] = IdentFunc
+			}
+			return
+		}
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.FuncDecl:
+			kinds[node.Name] = IdentFunc
+		case *ast.CallExpr:
+			markFunc(node.Fun)
+		case *ast.TypeSpec:
+			kinds[node.Name] = IdentType
+			markType(node.Type)
+		case *ast.Field:
+			markType(node.Type)
+		case *ast.StructType:
+			for _, field := range node.Fields.List {
+				for _, fieldName := range field.Names {
+					kinds[fieldName] = IdentField
+				}
+			}
+		case *ast.ValueSpec:
+			markType(node.Type)
+		case *ast.CompositeLit:
+			markType(node.Type)
+			for _, elt := range node.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					if key, ok := kv.Key.(*ast.Ident); ok {
+						kinds[key] = IdentField
+					}
+				}
+			}
+		case *ast.TypeAssertExpr:
+			markType(node.Type)
+		case *ast.SelectorExpr:
+			// calls and type references are marked by their parent, which is visited first
+			if _, marked := kinds[node.Sel]; !marked {
+				kinds[node.Sel] = IdentField
+			}
+		}
+		return true
+	})
+	return kinds
+}
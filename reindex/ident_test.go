@@ -0,0 +1,144 @@
+package reindex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/evanj/csearch/grep"
+)
+
+const identSource = `package example
+
+import (
+	"os"
+	"github.com/google/codesearch/index"
+)
+
+// Open opens things: not an identifier
+type Opener struct {
+	Open bool
+}
+
+type Open int
+
+func Open(path string) *index.Index {
+	var o Opener
+	o.Open = true
+	var f Open = "Open"
+	os.Open(path)
+	return index.Open(path)
+}
+`
+
+func locations(matches []*grep.Match) []string {
+	out := []string{}
+	for _, m := range matches {
+		out = append(out, fmt.Sprintf("%d:%d:%s", m.LineNumber, m.Start, m.Line[m.Start:m.End]))
+	}
+	return out
+}
+
+func TestGrepIdent(t *testing.T) {
+	tests := []struct {
+		kind     string
+		name     string
+		expected []string
+	}{
+		{IdentAny, "Open", []string{"10:1:Open", "13:5:Open", "15:5:Open", "17:3:Open", "18:7:Open", "19:4:Open", "20:14:Open"}},
+		{IdentFunc, "Open", []string{"15:5:Open", "19:4:Open", "20:14:Open"}},
+		{IdentType, "Open", []string{"13:5:Open", "18:7:Open"}},
+		{IdentType, "Index", []string{"15:30:Index"}},
+		{IdentField, "Open", []string{"10:1:Open", "17:3:Open"}},
+		{IdentImport, "index", []string{"5:1:\"github.com/google/codesearch/index\""}},
+		{IdentImport, "codesearch/index", []string{"5:1:\"github.com/google/codesearch/index\""}},
+		{IdentImport, "dex", []string{}},
+	}
+	for _, test := range tests {
+		output := locations(grepIdent("example.go", []byte(identSource), test.kind, test.name))
+		if !reflect.DeepEqual(test.expected, output) {
+			t.Errorf("%s:%s: expected %v; got %v", test.kind, test.name, test.expected, output)
+		}
+	}
+
+	// line directives do not change the locations
+	lineSource := "package p\n\n//line other.go:1000000:20\nfunc Open() {}\n"
+	output := locations(grepIdent("line.go", []byte(lineSource), IdentFunc, "Open"))
+	if !reflect.DeepEqual(output, []string{"4:5:Open"}) {
+		t.Errorf("with a line directive: expected [4:5:Open]; got %v", output)
+	}
+}
+
+func TestParseIdentQuery(t *testing.T) {
+	kind, name, err := ParseIdentQuery("Open")
+	if kind != IdentAny || name != "Open" || err != nil {
+		t.Error(kind, name, err)
+	}
+	kind, name, err = ParseIdentQuery("import:github.com/foo")
+	if kind != IdentImport || name != "github.com/foo" || err != nil {
+		t.Error(kind, name, err)
+	}
+	if _, _, err = ParseIdentQuery("var:Open"); err == nil {
+		t.Error("expected error for unknown kind")
+	}
+	if _, _, err = ParseIdentQuery("func:"); err == nil {
+		t.Error("expected error for empty name")
+	}
+}
+
+func TestSearchIdentEncodings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ident_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	source := "package p\n\n// café\nfunc Open() {}\n"
+	utf16Source := []byte("\xff\xfe")
+	for _, r := range utf16.Encode([]rune(source)) {
+		utf16Source = append(utf16Source, byte(r), byte(r>>8))
+	}
+	files := map[string]string{
+		"latin1.go": "package p\n\n// caf\xe9\nfunc Open() {}\n",
+		"utf16.go":  string(utf16Source),
+		"utf8.go":   source,
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// files are parsed after converting them to UTF-8
+	results, err := SearchIdent(index, IdentFunc, "Open", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, r := range results {
+		lines = append(lines, fmt.Sprintf("%s:%d:%s", filepath.Base(r.Path), r.LineNumber, r.Line))
+	}
+	expected := []string{"latin1.go:4:func Open() {}", "utf16.go:4:func Open() {}", "utf8.go:4:func Open() {}"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("results=%v; expected %v", lines, expected)
+	}
+}
@@ -0,0 +1,248 @@
+package reindex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evanj/csearch/atomicfile"
+	"github.com/evanj/csearch/symbol"
+	"github.com/google/codesearch/index"
+)
+
+// Writer creates an index and the per-file information stored alongside it.
+type Writer struct {
+	*index.IndexWriter
+	// Workers is the number of files IndexTree and IndexTrees read at once; 0 means GOMAXPROCS.
+	// SetMemoryBudget can limit it.
+	Workers int
+	// set by SetMemoryBudget, or 0 for no limit
+	maxWorkers int
+	// If not nil, Progress is called with the progress of IndexTree and IndexTrees every second,
+	// and once they are done, on the goroutine that called them.
+	Progress func(Progress)
+	path     string
+	// the temporary file the index is written to until it is complete
+	tmpPath string
+	skipped []Skipped
+	symbols []*symbol.Symbol
+	limits  []TextLimits
+}
+
+// Index is a trigram index and the per-file information stored alongside it.
+type Index struct {
+	*index.Index
+	// per-file information for version 1 indexes, which have no metadata
+	langs     []string
+	encodings []string
+	roots     []string
+	skipped   []Skipped
+}
+
+// Metadata keys stored in the index for each file.
+const (
+	MetaLang     = "lang"
+	MetaEncoding = "encoding"
+	// decimal bytes
+	MetaSize = "size"
+	// RFC 3339 in UTC
+	MetaModTime = "mtime"
+)
+
+// LangPath returns the path of the languages stored alongside version 1 indexes at indexPath.
+func LangPath(indexPath string) string {
+	return indexPath + ".lang"
+}
+
+// EncodingPath returns the path of the file encodings stored alongside version 1 indexes at
+// indexPath.
+func EncodingPath(indexPath string) string {
+	return indexPath + ".encoding"
+}
+
+// SetMemoryBudget sets the memory used to index files, like ShardedWriter.SetMemoryBudget for
+// a single shard. It must be called before adding files.
+func (w *Writer) SetMemoryBudget(bytes int64) {
+	var trigrams int64
+	w.maxWorkers, trigrams = splitMemoryBudget(bytes, w.Workers)
+	w.IndexWriter.SetMemoryBudget(trigrams)
+}
+
+// splitMemoryBudget divides a memory budget of bytes between the extractors of the workers
+// that read files (GOMAXPROCS if workers is 0) and the buffers of trigrams. The workers get at
+// most half of it, and at least one worker. It returns the number of workers and the memory
+// left for the buffers, which is at least 1: the index writer raises it to its minimum.
+func splitMemoryBudget(bytes int64, workers int) (int, int64) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if max := int(bytes / 2 / index.ExtractorMemory); workers > max {
+		workers = max
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	trigrams := bytes - int64(workers)*index.ExtractorMemory
+	if trigrams < 1 {
+		trigrams = 1
+	}
+	return workers, trigrams
+}
+
+// setMeta records the information about the file that was just added.
+func (w *Writer) setMeta(info os.FileInfo, fileLang string, encoding string) {
+	w.SetMeta(MetaLang, fileLang)
+	w.SetMeta(MetaEncoding, encoding)
+	w.SetMeta(MetaSize, strconv.FormatInt(info.Size(), 10))
+	w.SetMeta(MetaModTime, info.ModTime().UTC().Format(time.RFC3339Nano))
+}
+
+// FlushAndReopen finishes the index and the per-file information, syncs it to disk, renames it
+// over any existing index and opens it for reading. Indexes opened before the rename keep using
+// the old file. The symbols of the indexed files are written to SymbolPath: see OpenSymbols.
+func FlushAndReopen(writer *Writer) (*Index, error) {
+	ix, err := flushAndReopen(writer)
+	if err != nil {
+		return nil, err
+	}
+	_, err = writeSymbols(writer.symbols, ix.NumNames(), writer.path)
+	if err != nil {
+		ix.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+// flushAndReopen is FlushAndReopen without the symbols, which sharded indexes write for all
+// shards at once.
+func flushAndReopen(writer *Writer) (*Index, error) {
+	writer.Flush()
+	err := os.Rename(writer.tmpPath, writer.path)
+	if err != nil {
+		writer.Discard()
+		return nil, err
+	}
+	atomicfile.SyncDir(filepath.Dir(writer.path))
+	ix, err := index.TryOpen(writer.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the per-file information is in the index: remove files from older versions
+	for _, path := range []string{LangPath(writer.path), EncodingPath(writer.path)} {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	err = writeSkipped(SkippedPath(writer.path), writer.skipped)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{ix, nil, nil, ix.Paths(), writer.skipped}, nil
+}
+
+// Discard removes the partially written index, leaving any existing index in place. Use it
+// instead of FlushAndReopen if indexing fails.
+func (w *Writer) Discard() error {
+	err := os.Remove(w.tmpPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Open opens the index at indexPath. It returns an *index.CorruptError if the index is
+// truncated or invalid, but does not check all of it: see Verify. Version 1 indexes created
+// without per-file information can be opened, but all files have an unknown language and are
+// assumed to be UTF-8.
+func Open(indexPath string) (*Index, error) {
+	ix, err := index.TryOpen(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	var langs, encodings []string
+	if ix.Version() < 2 {
+		langs, err = readFileLines(ix, LangPath(indexPath))
+		if err != nil {
+			return nil, err
+		}
+		encodings, err = readFileLines(ix, EncodingPath(indexPath))
+		if err != nil {
+			return nil, err
+		}
+	}
+	skipped, err := readSkipped(SkippedPath(indexPath))
+	if err != nil {
+		return nil, err
+	}
+	return &Index{ix, langs, encodings, ix.Paths(), skipped}, nil
+}
+
+// readFileLines reads one line for each file id. It returns nil if path does not exist.
+func readFileLines(ix *index.Index, path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	lines := strings.Split(string(data), "\n")
+	// the last line is terminated
+	lines = lines[:len(lines)-1]
+	if len(lines) != ix.NumNames() {
+		return nil, fmt.Errorf("%s: %d lines for %d files", path, len(lines), ix.NumNames())
+	}
+	return lines, nil
+}
+
+// Returns the metadata value of key for fileid, or the line for fileid from lines for version
+// 1 indexes.
+func (ix *Index) meta(fileid uint32, key string, lines []string) string {
+	if ix.Version() >= 2 {
+		return ix.MetaValue(fileid, key)
+	}
+	if int(fileid) >= len(lines) {
+		return ""
+	}
+	return lines[fileid]
+}
+
+// Lang returns the language of fileid, or "" if it is unknown.
+func (ix *Index) Lang(fileid uint32) string {
+	return ix.meta(fileid, MetaLang, ix.langs)
+}
+
+// Encoding returns the encoding of fileid (see package charset): "" for UTF-8.
+func (ix *Index) Encoding(fileid uint32) string {
+	return ix.meta(fileid, MetaEncoding, ix.encodings)
+}
+
+// Skipped returns the files that were not indexed, in the order they were found. It returns
+// nil for indexes created without the list.
+func (ix *Index) Skipped() []Skipped {
+	return ix.skipped
+}
+
+// Root returns the indexed path that contains filepath, or "" if there is none.
+func (ix *Index) Root(filepath string) string {
+	return findRoot(ix.roots, filepath)
+}
+
+// findRoot returns the longest path in roots that contains filepath, or "" if there is none.
+func findRoot(roots []string, filepath string) string {
+	root := ""
+	for _, r := range roots {
+		if len(r) > len(root) && strings.HasPrefix(filepath, r) &&
+			(len(filepath) == len(r) || r[len(r)-1] == '/' || filepath[len(r)] == '/') {
+			root = r
+		}
+	}
+	return root
+}
@@ -0,0 +1,484 @@
+package reindex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evanj/csearch/lang"
+	"github.com/google/codesearch/index"
+)
+
+func TestIndexMeta(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	goPath := filepath.Join(tempDir, "a.go")
+	err = ioutil.WriteFile(goPath, []byte("package a\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2016, 1, 2, 3, 4, 5, 6, time.UTC)
+	err = os.Chtimes(goPath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(tempDir, "b"), []byte("caf\xe9\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexPath := filepath.Join(tempDir, ".index")
+	// per-file information files from older versions are removed
+	err = ioutil.WriteFile(LangPath(indexPath), []byte("stale\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(LangPath(indexPath)); !os.IsNotExist(err) {
+		t.Errorf("%s should not exist: %v", LangPath(indexPath), err)
+	}
+
+	ix, err := Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.Version() != 2 {
+		t.Errorf("Version()=%d; expected 2", ix.Version())
+	}
+	expected := map[string]string{MetaLang: lang.Go, MetaSize: "10", MetaModTime: "2016-01-02T03:04:05.000000006Z"}
+	if !reflect.DeepEqual(ix.Meta(0), expected) {
+		t.Errorf("Meta(0)=%v; expected %v", ix.Meta(0), expected)
+	}
+	if ix.MetaValue(1, MetaEncoding) != "windows-1252" || ix.MetaValue(1, MetaLang) != "" ||
+		ix.MetaValue(1, "unknown") != "" {
+		t.Errorf("Meta(1)=%v", ix.Meta(1))
+	}
+	if ix.Lang(0) != lang.Go || ix.Encoding(1) != "windows-1252" {
+		t.Errorf("Lang(0)=%#v Encoding(1)=%#v", ix.Lang(0), ix.Encoding(1))
+	}
+	keys := ix.MetaKeys()
+	sort.Strings(keys)
+	expectedKeys := []string{MetaEncoding, MetaLang, MetaModTime, MetaSize}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("MetaKeys()=%v; expected %v", keys, expectedKeys)
+	}
+}
+
+// Rewrites the version 2 index at path in version 1 format, by removing the metadata.
+func downgradeIndex(t *testing.T, path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const trailerMagic = "\ncsearch trailr\n"
+	// 7 offsets, 7 checksums, and the trailer checksum
+	trailer := len(data) - len(trailerMagic) - 15*4
+	metaData := binary.BigEndian.Uint32(data[trailer+5*4:])
+	v1 := []byte("csearch index 1\n")
+	v1 = append(v1, data[len(v1):metaData]...)
+	v1 = append(v1, data[trailer:trailer+5*4]...)
+	v1 = append(v1, trailerMagic...)
+	err = ioutil.WriteFile(path, v1, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenVersion1(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, name := range []string{"a.py", "b.txt"} {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte("hello "+name+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downgradeIndex(t, indexPath)
+
+	ix, err := Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.Version() != 1 || ix.Meta(0) != nil || len(ix.MetaKeys()) != 0 || ix.Lang(0) != "" {
+		t.Errorf("version 1 index: Version()=%d Meta(0)=%v Lang(0)=%#v", ix.Version(), ix.Meta(0), ix.Lang(0))
+	}
+	results, err := Search(ix, "hello", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results: %v", results)
+	}
+
+	// the languages are in a separate file
+	err = ioutil.WriteFile(LangPath(indexPath), []byte("python\n\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err = Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = Search(ix, "hello", Filter{Langs: []string{lang.Python}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !strings.HasSuffix(results[0].Path, "a.py") {
+		t.Errorf("expected a.py: %v", results)
+	}
+
+	err = ioutil.WriteFile(LangPath(indexPath), []byte("python\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(indexPath)
+	if err == nil {
+		t.Error("Open should fail if the number of languages is wrong")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, name := range []string{"a.go", "b.txt"} {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte("hello "+name+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ix.HasChecksums() {
+		t.Error("index should have checksums")
+	}
+	err = ix.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// changing a posting list is found by the checksums
+	changed := append([]byte(nil), data...)
+	// the first delta in the posting list for "hel"
+	i := bytes.Index(changed, []byte("hel"))
+	changed[i+3] = 5
+	writeAndVerify := func(data []byte) error {
+		err = ioutil.WriteFile(indexPath, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix, err := Open(indexPath)
+		if err != nil {
+			return err
+		}
+		return ix.Verify()
+	}
+	err = writeAndVerify(changed)
+	if _, ok := err.(*index.CorruptError); !ok || !strings.Contains(err.Error(), "posting lists checksum mismatch") {
+		t.Errorf("expected a checksum mismatch: %v", err)
+	}
+
+	// truncated or empty indexes cannot be opened
+	for _, truncated := range [][]byte{data[:len(data)-1], data[:len(data)/2], nil} {
+		err = writeAndVerify(truncated)
+		if _, ok := err.(*index.CorruptError); !ok {
+			t.Errorf("truncated to %d bytes: expected a CorruptError: %v", len(truncated), err)
+		}
+	}
+
+	// without checksums, the posting lists are checked
+	err = writeAndVerify(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downgradeIndex(t, indexPath)
+	v1, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeAndVerify(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i = bytes.Index(v1, []byte("hel"))
+	v1[i+3] = 5
+	err = writeAndVerify(v1)
+	if _, ok := err.(*index.CorruptError); !ok || !strings.Contains(err.Error(), "out of range") {
+		t.Errorf("expected a file id out of range: %v", err)
+	}
+
+	_, err = Open(filepath.Join(tempDir, "does_not_exist"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected does not exist: %v", err)
+	}
+	// a directory cannot be mapped
+	_, err = Open(tempDir)
+	if err == nil {
+		t.Error("expected an error opening a directory")
+	}
+}
+
+func buildIndex(t *testing.T, indexPath string, tree string) *Index {
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tree, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+func TestReplaceIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	for _, name := range []string{"old", "new"} {
+		err = os.Mkdir(filepath.Join(tempDir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(tempDir, name, name+".txt"), []byte(name+" file\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexPath := filepath.Join(tempDir, ".index")
+	old := buildIndex(t, indexPath, filepath.Join(tempDir, "old"))
+	defer old.Close()
+
+	// the old index can be opened until the new one is complete
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, filepath.Join(tempDir, "new"), indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ix.Paths(), []string{filepath.Join(tempDir, "old")}) {
+		t.Errorf("Paths()=%v while writing; expected the old index", ix.Paths())
+	}
+	ix.Close()
+
+	ix, err = FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if !reflect.DeepEqual(ix.Paths(), []string{filepath.Join(tempDir, "new")}) {
+		t.Errorf("Paths()=%v; expected the new index", ix.Paths())
+	}
+	// indexes opened before the rename still work
+	if old.Name(0) != filepath.Join(tempDir, "old", "old.txt") {
+		t.Errorf("old Name(0)=%#v", old.Name(0))
+	}
+
+	// a discarded index leaves the existing one in place
+	writer, err = Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Discard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err = Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if !reflect.DeepEqual(ix.Paths(), []string{filepath.Join(tempDir, "new")}) {
+		t.Errorf("Paths()=%v after Discard; expected the new index", ix.Paths())
+	}
+
+	tmpFiles, err := filepath.Glob(indexPath + ".tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Errorf("temporary files were not removed: %v", tmpFiles)
+	}
+}
+
+// Rewrites the version 3 index at path with a hole of gap bytes before
+// the name list, so the offsets after it do not fit in 32 bits. The
+// section checksums are not updated, since checking them would read
+// the whole hole.
+func spreadIndex(t *testing.T, path string, gap uint64) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const trailerMagic = "\ncsearch trlsum\n"
+	// 7 8-byte offsets, 7 checksums, and the trailer checksum
+	trailer := len(data) - len(trailerMagic) - 7*8 - 8*4
+	sums := trailer + 7*8
+	nameData := binary.BigEndian.Uint64(data[trailer+8:])
+	rest := append([]byte(nil), data[nameData:]...)
+	restTrailer := rest[uint64(trailer)-nameData:]
+	for i := 1; i < 7; i++ {
+		off := binary.BigEndian.Uint64(restTrailer[i*8:])
+		binary.BigEndian.PutUint64(restTrailer[i*8:], off+gap)
+	}
+	sum := crc32.Checksum(restTrailer[:sums-trailer+7*4], crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(restTrailer[sums-trailer+7*4:], sum)
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.Write(data[:nameData])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(rest, int64(nameData+gap))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLargeIndex(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("indexes larger than 4GB cannot be mapped")
+	}
+	tempDir, err := ioutil.TempDir("", "index_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	names := []string{"a.go", "b.txt"}
+	for _, name := range names {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte("hello "+name+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.LargeOffsets = true
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.Version() != 3 {
+		t.Errorf("Version()=%d; expected 3", ix.Version())
+	}
+	err = ix.Verify()
+	if err != nil {
+		t.Error(err)
+	}
+	ix.Close()
+
+	// the reader finds the sections past 4GB
+	spreadIndex(t, indexPath, 1<<32+1000)
+	ix, err = Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if !reflect.DeepEqual(ix.Paths(), []string{tempDir}) {
+		t.Errorf("Paths()=%v; expected %v", ix.Paths(), []string{tempDir})
+	}
+	for i, name := range names {
+		if ix.Name(uint32(i)) != filepath.Join(tempDir, name) {
+			t.Errorf("Name(%d)=%#v; expected %#v", i, ix.Name(uint32(i)), filepath.Join(tempDir, name))
+		}
+	}
+	if ix.Lang(0) != lang.Go {
+		t.Errorf("Lang(0)=%#v; expected %#v", ix.Lang(0), lang.Go)
+	}
+	results, err := Search(ix, "hello", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Errorf("expected 2 results: %v", results)
+	}
+	results, err = Search(ix, "hello b.txt", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !strings.HasSuffix(results[0].Path, "b.txt") {
+		t.Errorf("expected b.txt: %v", results)
+	}
+}
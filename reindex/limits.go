@@ -0,0 +1,104 @@
+package reindex
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/codesearch/index"
+)
+
+// TextLimits overrides the limits the writer uses to detect text files, for paths that match
+// Glob. Zero limits keep the writer's defaults.
+type TextLimits struct {
+	// Matches the file name, or the last path elements if it contains slashes, like
+	// "testdata/*.json"
+	Glob            string
+	MaxFileLen      int64
+	MaxLineLen      int
+	MaxTextTrigrams int
+}
+
+func (l *TextLimits) match(path string) bool {
+	n := strings.Count(l.Glob, "/") + 1
+	elems := strings.Split(filepath.ToSlash(path), "/")
+	if len(elems) > n {
+		elems = elems[len(elems)-n:]
+	}
+	matched, _ := filepath.Match(l.Glob, strings.Join(elems, "/"))
+	return matched
+}
+
+// ParseTextLimits parses rules separated by ";" of the form glob:name=value,name=value, where
+// the names are fileLen, lineLen and trigrams, e.g. "*.json:lineLen=20000;*.csv:fileLen=1e9".
+func ParseTextLimits(s string) ([]TextLimits, error) {
+	var limits []TextLimits
+	for _, rule := range strings.Split(s, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		colon := strings.LastIndex(rule, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("text limits %#v: expected glob:name=value", rule)
+		}
+		l := TextLimits{Glob: rule[:colon]}
+		if _, err := filepath.Match(l.Glob, ""); err != nil {
+			return nil, fmt.Errorf("text limits %#v: %s", rule, err.Error())
+		}
+		for _, setting := range strings.Split(rule[colon+1:], ",") {
+			parts := strings.SplitN(setting, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("text limits %#v: expected name=value: %#v", rule, setting)
+			}
+			name := strings.TrimSpace(parts[0])
+			value, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			if err != nil || value < 1 || value != float64(int64(value)) {
+				return nil, fmt.Errorf("text limits %#v: invalid %s: %#v", rule, name, parts[1])
+			}
+			switch name {
+			case "fileLen":
+				l.MaxFileLen = int64(value)
+			case "lineLen":
+				l.MaxLineLen = int(value)
+			case "trigrams":
+				l.MaxTextTrigrams = int(value)
+			default:
+				return nil, fmt.Errorf("text limits %#v: unknown limit %#v", rule, name)
+			}
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// SetTextLimits overrides the limits for files that match each rule. The first matching rule
+// applies, and files that match none use the defaults.
+func (w *Writer) SetTextLimits(limits []TextLimits) {
+	w.limits = limits
+}
+
+// setLimits configures e with the writer's limits for path.
+func (w *Writer) setLimits(e *index.Extractor, path string) {
+	// the writer's limits can be changed after Create
+	l := TextLimits{MaxFileLen: w.MaxFileLen, MaxLineLen: w.MaxLineLen, MaxTextTrigrams: w.MaxTextTrigrams}
+	for i := range w.limits {
+		if w.limits[i].match(path) {
+			if w.limits[i].MaxFileLen > 0 {
+				l.MaxFileLen = w.limits[i].MaxFileLen
+			}
+			if w.limits[i].MaxLineLen > 0 {
+				l.MaxLineLen = w.limits[i].MaxLineLen
+			}
+			if w.limits[i].MaxTextTrigrams > 0 {
+				l.MaxTextTrigrams = w.limits[i].MaxTextTrigrams
+			}
+			break
+		}
+	}
+	e.MaxFileLen = l.MaxFileLen
+	e.MaxLineLen = l.MaxLineLen
+	e.MaxTextTrigrams = l.MaxTextTrigrams
+	e.LogSkip = w.LogSkip
+}
@@ -0,0 +1,104 @@
+package reindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTextLimits(t *testing.T) {
+	limits, err := ParseTextLimits("*.json:lineLen=20000; testdata/*.csv:fileLen=2e9,trigrams=100000;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TextLimits{
+		{Glob: "*.json", MaxLineLen: 20000},
+		{Glob: "testdata/*.csv", MaxFileLen: 2000000000, MaxTextTrigrams: 100000},
+	}
+	if !reflect.DeepEqual(limits, expected) {
+		t.Errorf("ParseTextLimits()=%v; expected %v", limits, expected)
+	}
+
+	for _, invalid := range []string{"*.json", "*.json:lineLen", "*.json:lines=5", "*.json:lineLen=0",
+		"*.json:lineLen=1.5", "[:lineLen=5"} {
+		_, err := ParseTextLimits(invalid)
+		if err == nil {
+			t.Errorf("ParseTextLimits(%#v) should return an error", invalid)
+		}
+	}
+}
+
+func TestTextLimitsMatch(t *testing.T) {
+	tests := []struct {
+		glob    string
+		path    string
+		matched bool
+	}{
+		{"*.json", "/a/b/c.json", true},
+		{"*.json", "c.json", true},
+		{"*.json", "/a/b.json/c.go", false},
+		{"b/*.json", "/a/b/c.json", true},
+		{"b/*.json", "/a/x/c.json", false},
+		{"a/*/*.json", "/a/b/c.json", true},
+	}
+	for i, test := range tests {
+		l := &TextLimits{Glob: test.glob}
+		if l.match(test.path) != test.matched {
+			t.Errorf("%d: %#v match(%#v)=%t; expected %t", i, test.glob, test.path, !test.matched, test.matched)
+		}
+	}
+}
+
+func TestSetTextLimits(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "limits_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// longer than bufio's default limit on lines
+	files := map[string]int{"a.json": 100000, "b.txt": 3000, "c.txt": 6000}
+	for name, lineLen := range files {
+		line := "{\"k\": \"" + strings.Repeat("x", lineLen) + "\"}\n"
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte(line), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writer, err := Create(filepath.Join(tempDir, ".index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// changing the writer's limits changes the defaults
+	writer.MaxLineLen = 5000
+	writer.SetTextLimits([]TextLimits{{Glob: "*.json", MaxLineLen: 200000}})
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ix.NumNames() != 2 || ix.Name(0) != filepath.Join(tempDir, "a.json") ||
+		ix.Name(1) != filepath.Join(tempDir, "b.txt") {
+		t.Errorf("expected a.json and b.txt to be indexed; NumNames()=%d", ix.NumNames())
+	}
+	skipped := ix.Skipped()
+	if len(skipped) != 1 || skipped[0].Path != filepath.Join(tempDir, "c.txt") {
+		t.Errorf("expected c.txt to be skipped: %v", skipped)
+	}
+
+	results, err := Search(ix, "xxxx", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || len(results[0].Line) != 100000+len("{\"k\": \"\"}") {
+		t.Errorf("expected the long lines: %d results", len(results))
+	}
+}
@@ -0,0 +1,208 @@
+package reindex
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/evanj/csearch/symbol"
+	"github.com/google/codesearch/index"
+)
+
+// Files are read and their trigrams extracted by several workers at once, but they are added to
+// the index on one goroutine in the order of a serial walk of each tree in turn. File IDs are
+// assigned in the order files are added, so the index is the same as one built serially. Each
+// tree is walked on its own goroutine, and the files it finds wait in a queue until the files
+// from the trees before it have been handed to the workers.
+
+// walkQueueLen is the number of files each tree's walker can find ahead of the workers.
+const walkQueueLen = 1024
+
+// progressInterval is how often indexing reports its progress; tests change it.
+var progressInterval = time.Second
+
+// Progress describes how far indexing has got.
+type Progress struct {
+	// Files found by walking the trees so far, and their total size in bytes
+	FilesSeen int
+	BytesSeen int64
+	// Files added to the index, files that were skipped, and the total size of both
+	FilesIndexed int
+	FilesSkipped int
+	Bytes        int64
+	// Whether the trees have all been walked, so every file to index has been seen
+	Walked  bool
+	Elapsed time.Duration
+}
+
+// ETA estimates the time left to index the files seen so far, from the rate at which bytes have
+// been indexed. It is a lower bound until the trees have been walked, and 0 before any bytes have
+// been indexed.
+func (p Progress) ETA() time.Duration {
+	if p.Bytes == 0 {
+		return 0
+	}
+	left := float64(p.Elapsed) * float64(p.BytesSeen-p.Bytes) / float64(p.Bytes)
+	return time.Duration(left).Round(time.Second)
+}
+
+// Added reports whether every file has been added to the index, which is then ready to be
+// written.
+func (p Progress) Added() bool {
+	return p.Walked && p.FilesIndexed+p.FilesSkipped == p.FilesSeen
+}
+
+func (p Progress) String() string {
+	s := fmt.Sprintf("%d of %d files indexed (%.1f of %.1f MB), %d skipped",
+		p.FilesIndexed+p.FilesSkipped, p.FilesSeen, float64(p.Bytes)/(1<<20), float64(p.BytesSeen)/(1<<20),
+		p.FilesSkipped)
+	if p.Added() {
+		return s + ", writing the index"
+	}
+	if !p.Walked {
+		s += ", still finding files"
+	}
+	if eta := p.ETA(); eta > 0 {
+		if p.Walked {
+			s += fmt.Sprintf(", about %s left", eta)
+		} else {
+			s += fmt.Sprintf(", at least %s left", eta)
+		}
+	}
+	return s
+}
+
+// indexedFile is a file found while walking a tree, and the result of reading it.
+type indexedFile struct {
+	path string
+	info os.FileInfo
+	w    *Writer // the writer the file is added to
+
+	trigrams *index.FileTrigrams
+	lang     string
+	encoding string
+	symbols  []*symbol.Symbol
+	err      error
+	done     chan struct{} // closed once the fields above are set
+}
+
+// limitWorkers returns workers, or GOMAXPROCS if it is 0, limited to max if it is not 0.
+func limitWorkers(workers int, max int) int {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if max > 0 && workers > max {
+		workers = max
+	}
+	return workers
+}
+
+// indexTrees adds the files in trees to the writers returned by writerFor, which is called with
+// the number of the tree and the file's path. It reads files on workers goroutines, or on
+// GOMAXPROCS if workers is 0. If progress is not nil, it is called every progressInterval until
+// all files have been added, even while waiting for the walk or for a file to be read, and once
+// they have all been added.
+func indexTrees(trees []string, shouldIndex func(string, os.FileInfo) bool, workers int,
+	progress func(Progress), writerFor func(tree int, path string) *Writer) error {
+
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	// updated by the walkers
+	var filesSeen, bytesSeen, walking int64 = 0, 0, int64(len(trees))
+	found := make([]chan *indexedFile, len(trees))
+	walkErrs := make([]error, len(trees))
+	for i, tree := range trees {
+		found[i] = make(chan *indexedFile, walkQueueLen)
+		go func(i int, tree string) {
+			defer close(found[i])
+			walkErrs[i] = walkTree(tree, shouldIndex, func(path string, info os.FileInfo) {
+				atomic.AddInt64(&filesSeen, 1)
+				atomic.AddInt64(&bytesSeen, info.Size())
+				found[i] <- &indexedFile{path: path, info: info, w: writerFor(i, path), done: make(chan struct{})}
+			})
+			atomic.AddInt64(&walking, -1)
+		}(i, tree)
+	}
+
+	// hand out the files in order, and queue them in the same order to be added; the length of
+	// the queue limits how far the workers can get ahead of the writer
+	work := make(chan *indexedFile)
+	ordered := make(chan *indexedFile, 4*workers)
+	go func() {
+		for _, files := range found {
+			for file := range files {
+				work <- file
+				ordered <- file
+			}
+		}
+		close(work)
+		close(ordered)
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			e := &index.Extractor{}
+			for file := range work {
+				file.w.extractFile(e, file)
+				close(file.done)
+			}
+		}()
+	}
+
+	start := time.Now()
+	var ticks <-chan time.Time
+	if progress != nil {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var p Progress
+	report := func() {
+		p.FilesSeen = int(atomic.LoadInt64(&filesSeen))
+		p.BytesSeen = atomic.LoadInt64(&bytesSeen)
+		p.Walked = atomic.LoadInt64(&walking) == 0
+		p.Elapsed = time.Since(start)
+		progress(p)
+	}
+	for {
+		var file *indexedFile
+		ok := false
+		select {
+		case file, ok = <-ordered:
+		case <-ticks:
+			report()
+			continue
+		}
+		if !ok {
+			break
+		}
+		for waiting := true; waiting; {
+			select {
+			case <-file.done:
+				waiting = false
+			case <-ticks:
+				report()
+			}
+		}
+		file.w.addFile(file)
+		if file.err != nil {
+			p.FilesSkipped++
+		} else {
+			p.FilesIndexed++
+		}
+		p.Bytes += file.info.Size()
+	}
+	if progress != nil {
+		report()
+	}
+	for _, err := range walkErrs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package reindex
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes files of several kinds, including ones that are skipped, to trees in tempDir.
+func writeTrees(t *testing.T, tempDir string) []string {
+	var trees []string
+	for _, tree := range []string{"b", "a"} {
+		trees = append(trees, filepath.Join(tempDir, tree))
+		for i := 0; i < 100; i++ {
+			files := map[string]string{
+				fmt.Sprintf("%d/file%d.go", i%7, i):    fmt.Sprintf("package p%d\n\nfunc F%d() {}\n", i, i*i),
+				fmt.Sprintf("%d/latin%d.txt", i%5, i):  fmt.Sprintf("caf\xe9 %d\n", i),
+				fmt.Sprintf("%d/long%d.json", i%3, i):  "{\"k\": \"" + strings.Repeat("x", 3000+i) + "\"}\n",
+				fmt.Sprintf("%d/binary%d.dat", i%3, i): fmt.Sprintf("%d\x00\xff\xfe\x01\n", i),
+			}
+			for name, data := range files {
+				path := filepath.Join(tempDir, tree, name)
+				err := os.MkdirAll(filepath.Dir(path), 0700)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = ioutil.WriteFile(path, []byte(data), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	return trees
+}
+
+// Returns the contents of the index files at indexPath.
+func readIndexFiles(t *testing.T, indexPath string) map[string][]byte {
+	paths, err := filepath.Glob(indexPath + "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[filepath.Base(path)] = data
+	}
+	return files
+}
+
+func TestParallelIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "parallel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	trees := writeTrees(t, tempDir)
+	limits := []TextLimits{{Glob: "1/*.json", MaxLineLen: 20000}}
+
+	build := func(name string, workers int) map[string][]byte {
+		indexPath := filepath.Join(tempDir, name)
+		writer, err := Create(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Workers = workers
+		writer.SetTextLimits(limits)
+		err = IndexTrees(writer, trees, indexAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix, err := FlushAndReopen(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		if len(ix.Skipped()) != 2*100*2-2*33 {
+			t.Errorf("%d workers: %d skipped files", workers, len(ix.Skipped()))
+		}
+		symbols, err := OpenSymbols(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if symbols.Len() != 2*100 {
+			t.Errorf("%d workers: %d symbols", workers, symbols.Len())
+		}
+		return readIndexFiles(t, indexPath)
+	}
+	serial := build(".serial", 1)
+	if len(serial) != 3 {
+		t.Errorf("expected the index, skipped and symbol files: %d files", len(serial))
+	}
+	parallel := build(".parallel", 8)
+	for name, data := range serial {
+		parallelName := strings.Replace(name, ".serial", ".parallel", 1)
+		if !bytes.Equal(parallel[parallelName], data) {
+			t.Errorf("%s differs from %s", parallelName, name)
+		}
+	}
+
+	buildSharded := func(name string, by string, workers int) map[string][]byte {
+		indexPath := filepath.Join(tempDir, name)
+		writer, err := CreateSharded(indexPath, by, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Workers = workers
+		writer.SetTextLimits(limits)
+		err = IndexShardedTrees(writer, trees, indexAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix, err := FlushAndReopenSharded(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ix.Symbols().Len() != 2*100 {
+			t.Errorf("%s %d workers: %d symbols", by, workers, ix.Symbols().Len())
+		}
+		ix.Close()
+		return readIndexFiles(t, indexPath)
+	}
+	for _, by := range []string{ShardByHash, ShardByRoot} {
+		serial := buildSharded(".serial"+by, by, 1)
+		parallel := buildSharded(".parallel"+by, by, 8)
+		if len(serial) != len(parallel) || len(serial) < 5 {
+			t.Errorf("%s: %d serial files, %d parallel files", by, len(serial), len(parallel))
+		}
+		for name, data := range serial {
+			if name == ".serial"+by+".shards" {
+				// lists the shard file names
+				continue
+			}
+			parallelName := strings.Replace(name, ".serial", ".parallel", 1)
+			if !bytes.Equal(parallel[parallelName], data) {
+				t.Errorf("%s differs from %s", parallelName, name)
+			}
+		}
+	}
+}
+
+func TestMemoryBudgetAndProgress(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "parallel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	trees := writeTrees(t, tempDir)
+	// enough trigrams to fill a 1MB budget several times
+	for i := 0; i < 40; i++ {
+		var words []string
+		for j := 0; j < 3000; j++ {
+			words = append(words, fmt.Sprintf("%x", (i*3000+j)*7919))
+		}
+		path := filepath.Join(trees[0], fmt.Sprintf("words%d.txt", i))
+		err = ioutil.WriteFile(path, []byte(strings.Join(words, "\n")+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build := func(name string, memory int64) (map[string][]byte, []Progress) {
+		indexPath := filepath.Join(tempDir, name)
+		writer, err := Create(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if memory > 0 {
+			writer.SetMemoryBudget(memory)
+		}
+		var reports []Progress
+		writer.Progress = func(p Progress) {
+			reports = append(reports, p)
+		}
+		err = IndexTrees(writer, trees, indexAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix, err := FlushAndReopen(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.Close()
+		return readIndexFiles(t, indexPath), reports
+	}
+	expected, reports := build(".default", 0)
+	small, _ := build(".small", 1<<20)
+	for name, data := range expected {
+		smallName := strings.Replace(name, ".default", ".small", 1)
+		if !bytes.Equal(small[smallName], data) {
+			t.Errorf("%s differs from %s", smallName, name)
+		}
+	}
+
+	if len(reports) == 0 {
+		t.Fatal("Progress was not called")
+	}
+	last := reports[len(reports)-1]
+	files := 2*100*4 + 40
+	if last.FilesSeen != files || last.FilesIndexed+last.FilesSkipped != files || last.FilesSkipped != 2*(100+100) ||
+		!last.Walked || !last.Added() || last.Bytes != last.BytesSeen || last.ETA() != 0 {
+		t.Errorf("last progress: %#v", last)
+	}
+	if !strings.HasSuffix(last.String(), ", writing the index") {
+		t.Errorf("last progress: %#v", last.String())
+	}
+
+	p := Progress{FilesSeen: 10, BytesSeen: 4000, FilesIndexed: 2, FilesSkipped: 1, Bytes: 1000, Elapsed: 5 * time.Second}
+	if p.ETA() != 15*time.Second {
+		t.Errorf("ETA()=%s; expected 15s", p.ETA())
+	}
+	expectedString := "3 of 10 files indexed (0.0 of 0.0 MB), 1 skipped, still finding files, at least 15s left"
+	if p.String() != expectedString {
+		t.Errorf("String()=%#v; expected %#v", p.String(), expectedString)
+	}
+}
+
+func TestSplitMemoryBudget(t *testing.T) {
+	const mb = 1 << 20
+	tests := []struct {
+		bytes    int64
+		workers  int
+		expected int
+		trigrams int64
+	}{
+		{1024 * mb, 4, 4, 768 * mb},
+		{256 * mb, 8, 2, 128 * mb},
+		{200 * mb, 8, 1, 136 * mb},
+		{mb, 4, 1, 1},
+	}
+	for _, test := range tests {
+		workers, trigrams := splitMemoryBudget(test.bytes, test.workers)
+		if workers != test.expected || trigrams != test.trigrams {
+			t.Errorf("splitMemoryBudget(%d, %d)=%d, %d; expected %d, %d",
+				test.bytes, test.workers, workers, trigrams, test.expected, test.trigrams)
+		}
+	}
+}
+
+func TestProgressWhileWalking(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "parallel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	for i := 0; i < 3; i++ {
+		err = ioutil.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%d.txt", i)), []byte("hello\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(interval time.Duration) {
+		progressInterval = interval
+	}(progressInterval)
+	progressInterval = 10 * time.Millisecond
+
+	writer, err := Create(filepath.Join(tempDir, ".index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Discard()
+	var reports []Progress
+	writer.Progress = func(p Progress) {
+		reports = append(reports, p)
+	}
+	// a slow walk that skips every file
+	skipSlowly := func(path string, info os.FileInfo) bool {
+		time.Sleep(100 * time.Millisecond)
+		return false
+	}
+	err = IndexTree(writer, tempDir, skipSlowly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) < 3 || reports[0].Walked || !reports[len(reports)-1].Walked {
+		t.Errorf("expected progress while walking: %v", reports)
+	}
+}
@@ -1,34 +1,65 @@
 package reindex
 
 import (
+	"bytes"
 	"errors"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"regexp/syntax"
+	"strings"
 	"time"
 
+	"github.com/evanj/csearch/charset"
 	"github.com/evanj/csearch/grep"
+	"github.com/evanj/csearch/lang"
+	"github.com/evanj/csearch/symbol"
 	"github.com/google/codesearch/index"
 )
 
 const minQueryLength = 3
 
-func Create(indexPath string) (*index.IndexWriter, error) {
-	err := os.Remove(indexPath)
-	if err != nil && !os.IsNotExist(err) {
+// Create starts writing a new index to a temporary file in the same directory as indexPath.
+// Any existing index stays in place and can still be used until FlushAndReopen renames the new
+// one over it.
+func Create(indexPath string) (*Writer, error) {
+	f, err := ioutil.TempFile(filepath.Dir(indexPath), filepath.Base(indexPath)+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := f.Name()
+	err = f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
 		return nil, err
 	}
 
-	ix := index.Create(indexPath)
-	return ix, nil
+	ix := index.Create(tmpPath)
+	return &Writer{IndexWriter: ix, path: indexPath, tmpPath: tmpPath}, nil
 }
 
-func IndexTree(ix *index.IndexWriter, tree string, shouldIndex func(string, os.FileInfo) bool) error {
-	ix.AddPaths([]string{tree})
+// IndexTree adds the files in tree that shouldIndex accepts to the index.
+func IndexTree(ix *Writer, tree string, shouldIndex func(string, os.FileInfo) bool) error {
+	return IndexTrees(ix, []string{tree}, shouldIndex)
+}
 
-	err := filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+// IndexTrees adds the files in trees to the index, like calling IndexTree for each one, but
+// walks the trees and reads the files in parallel; see indexTrees. shouldIndex may be called
+// from several goroutines at once.
+func IndexTrees(ix *Writer, trees []string, shouldIndex func(string, os.FileInfo) bool) error {
+	ix.AddPaths(trees)
+	workers := limitWorkers(ix.Workers, ix.maxWorkers)
+	return indexTrees(trees, shouldIndex, workers, ix.Progress, func(tree int, path string) *Writer {
+		return ix
+	})
+}
+
+// walkTree calls add for each file in tree that should be indexed, in filepath.Walk order.
+func walkTree(tree string, shouldIndex func(string, os.FileInfo) bool, add func(string, os.FileInfo)) error {
+	return filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
 		if _, elem := filepath.Split(path); elem != "" {
 			// Skip various temporary or "hidden" files or directories.
 			if elem[0] == '.' || elem[0] == '#' || elem[0] == '~' || elem[len(elem)-1] == '~' {
@@ -48,22 +79,145 @@ func IndexTree(ix *index.IndexWriter, tree string, shouldIndex func(string, os.F
 		}
 
 		if info.Mode()&os.ModeType == 0 {
-			ix.AddFile(path)
+			add(path, info)
 		}
 		return nil
 	})
-	return err
 }
 
-// TODO: get path from writer? Don't include this at all? (it does make imports easier)
-func FlushAndReopen(writer *index.IndexWriter, path string) *index.Index {
-	writer.Flush()
-	return index.Open(path)
+// addFile adds a file read by extractFile to the index, or records why it was skipped.
+func (ix *Writer) addFile(file *indexedFile) {
+	if skipErr, ok := file.err.(*index.SkipError); ok {
+		ix.skipped = append(ix.skipped, newSkipped(skipErr))
+		return
+	}
+	ix.AddTrigrams(file.trigrams)
+	ix.setMeta(file.info, file.lang, file.encoding)
+	ix.symbols = append(ix.symbols, file.symbols...)
+}
+
+// extractFile reads file using e, and sets its language, trigrams, encoding and symbols, or
+// the *index.SkipError if it should not be indexed.
+func (ix *Writer) extractFile(e *index.Extractor, file *indexedFile) {
+	ix.setLimits(e, file.path)
+	f, err := os.Open(file.path)
+	if err != nil {
+		log.Print(err)
+		file.err = &index.SkipError{Name: file.path, Reason: index.SkipReadError, Err: err}
+		return
+	}
+	defer f.Close()
+	ix.extractReader(e, file, f, file.info.Size())
+}
+
+// extractReader reads file from f, which has size bytes, like extractFile. The language is
+// detected from the beginning of the file that is read to detect its encoding.
+func (ix *Writer) extractReader(e *index.Extractor, file *indexedFile, f io.ReadSeeker, size int64) {
+	prefix := make([]byte, charset.SniffLen)
+	n, err := io.ReadFull(f, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("%s: %v", file.path, err)
+		file.err = &index.SkipError{Name: file.path, Reason: index.SkipReadError, Err: err}
+		return
+	}
+	prefix = prefix[:n]
+
+	fileLang := lang.Detect(file.path, prefix)
+	keep := symbol.Supported(fileLang)
+	var data []byte
+	file.trigrams, file.encoding, data, file.err = ix.extractText(e, file.path, prefix, f, size, keep)
+	if file.err != nil {
+		return
+	}
+	file.lang = fileLang
+	if keep {
+		file.symbols = symbol.Extract(file.path, fileLang, data)
+	}
+}
+
+// extractText finds the trigrams of the file at path, which starts with prefix followed by the
+// rest of f, converting it to UTF-8 if it has a byte order mark, looks like UTF-16, or is not
+// valid UTF-8 but looks like text. It returns a *index.SkipError if the file should not be
+// indexed, or its trigrams and encoding, and if keep is set, its contents converted to UTF-8.
+func (ix *Writer) extractText(e *index.Extractor, path string, prefix []byte, f io.ReadSeeker, size int64,
+	keep bool) (*index.FileTrigrams, string, []byte, error) {
+
+	encoding := charset.Sniff(prefix)
+	if encoding == charset.UTF8 || size > e.MaxFileLen {
+		var r io.Reader = io.MultiReader(bytes.NewReader(prefix), f)
+		var kept bytes.Buffer
+		if keep {
+			r = io.TeeReader(r, &kept)
+		}
+		trigrams, err := e.Extract(path, r)
+		skipErr, ok := err.(*index.SkipError)
+		if !ok || skipErr.Reason != index.SkipInvalidUTF8 || size > e.MaxFileLen {
+			return trigrams, charset.UTF8, kept.Bytes(), err
+		}
+		// Detect rejects files that are not UTF-8 and have control characters, which binary
+		// files usually have near the start: skip them without reading the rest
+		if charset.HasControl(prefix) {
+			return nil, "", nil, err
+		}
+		// not UTF-8: read the whole file to check if it looks like text
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, "", nil, &index.SkipError{Name: path, Reason: index.SkipReadError, Err: err}
+		}
+		prefix = nil
+	}
+
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		log.Printf("%s: %v", path, err)
+		return nil, "", nil, &index.SkipError{Name: path, Reason: index.SkipReadError, Err: err}
+	}
+	data := append(prefix, rest...)
+	if encoding == charset.UTF8 {
+		encoding, err = charset.Detect(data)
+		if err != nil {
+			// report the original reason
+			trigrams, err := e.Extract(path, bytes.NewReader(data))
+			return trigrams, "", data, err
+		}
+	}
+	decoded, err := charset.Decode(data, encoding)
+	if err != nil {
+		return nil, "", nil, &index.SkipError{Name: path, Reason: index.SkipReadError, Err: err}
+	}
+	trigrams, err := e.Extract(path, bytes.NewReader(decoded))
+	return trigrams, encoding, decoded, err
+}
+
+// Result is a matching line.
+type Result struct {
+	*grep.Match
+	Lang string
+}
+
+// Searcher is an index that can be searched: an *Index or a *ShardedIndex.
+type Searcher interface {
+	// Root returns the indexed path that contains filepath, or "" if there is none.
+	Root(filepath string) string
+	search(qString string, filter Filter) ([]*Result, error)
+	searchIdent(kind string, name string, filter Filter) ([]*Result, error)
+}
+
+// search is Search, returning an *index.CorruptError if the index has invalid data.
+func (ix *Index) search(qString string, filter Filter) (results []*Result, err error) {
+	defer ix.CatchCorrupt(&err)
+	return Search(ix, qString, filter)
 }
 
-// Returns matches that match qString and fileRegexp. Ignores files that exist in the
+// searchIdent is SearchIdent, returning an *index.CorruptError if the index has invalid data.
+func (ix *Index) searchIdent(kind string, name string, filter Filter) (results []*Result, err error) {
+	defer ix.CatchCorrupt(&err)
+	return SearchIdent(ix, kind, name, filter)
+}
+
+// Returns matches that match qString in files that match filter. Ignores files that exist in the
 // index but cannot be opened. This usually indicates that the index is out of date.
-func Search(ix *index.Index, qString string, fileRegexp string) ([]*grep.Match, error) {
+func Search(ix *Index, qString string, filter Filter) ([]*Result, error) {
 	start := time.Now()
 
 	if len(qString) < minQueryLength {
@@ -78,7 +232,7 @@ func Search(ix *index.Index, qString string, fileRegexp string) ([]*grep.Match,
 		return nil, err
 	}
 	indexQuery := index.RegexpQuery(qSyntax)
-	fileRe, err := regexp.Compile(fileRegexp)
+	compiledFilter, err := filter.compile(ix)
 	if err != nil {
 		return nil, err
 	}
@@ -90,15 +244,16 @@ func Search(ix *index.Index, qString string, fileRegexp string) ([]*grep.Match,
 	realMatches := 0
 	fileMatches := 0
 	notFound := 0
-	var results []*grep.Match
+	var results []*Result
 	for _, fileId := range postingList {
 		name := ix.Name(fileId)
-		if !fileRe.MatchString(name) {
+		fileLang := ix.Lang(fileId)
+		if !compiledFilter.match(name, fileLang) {
 			continue
 		}
 		fileMatches += 1
 
-		matches, err := grep.Grep(re, name)
+		matches, err := grep.GrepEncoding(re, name, ix.Encoding(fileId))
 		if err != nil {
 			if os.IsNotExist(err) {
 				// TODO: Warn when file not found? Requires changing match structure?
@@ -110,7 +265,9 @@ func Search(ix *index.Index, qString string, fileRegexp string) ([]*grep.Match,
 		if len(matches) > 0 {
 			realMatches += 1
 		}
-		results = append(results, matches...)
+		for _, match := range matches {
+			results = append(results, &Result{match, fileLang})
+		}
 	}
 	grepTime := time.Now()
 	log.Printf("posting matches: %d; file matches: %d; real matches: %d (false positives: %d; not found: %d)",
@@ -119,3 +276,33 @@ func Search(ix *index.Index, qString string, fileRegexp string) ([]*grep.Match,
 		postingTime.Sub(start).Seconds(), grepTime.Sub(postingTime).Seconds())
 	return results, nil
 }
+
+// Queries with this prefix search the symbol table instead of file contents
+const SymbolQueryPrefix = "sym:"
+
+// Queries with this prefix search Go identifiers: ident:(name) or ident:(kind):(name)
+const IdentQueryPrefix = "ident:"
+
+// SearchQuery runs a query from the search box: filter terms (see ParseQuery), then
+// sym:(name), ident:[kind:]name, or a regexp. fileRegexp restricts the file paths, and
+// maxSymbols limits the symbol matches. It returns the pattern and filter it parsed.
+func SearchQuery(ix Searcher, symbols *symbol.Table, q string, fileRegexp string, maxSymbols int) (
+	string, Filter, []*Result, error) {
+
+	pattern, filter := ParseQuery(q)
+	filter.File = fileRegexp
+	var results []*Result
+	var err error
+	if strings.HasPrefix(pattern, SymbolQueryPrefix) {
+		results, err = SearchSymbols(ix, symbols, pattern[len(SymbolQueryPrefix):], filter, maxSymbols)
+	} else if strings.HasPrefix(pattern, IdentQueryPrefix) {
+		var kind, name string
+		kind, name, err = ParseIdentQuery(pattern[len(IdentQueryPrefix):])
+		if err == nil {
+			results, err = ix.searchIdent(kind, name, filter)
+		}
+	} else {
+		results, err = ix.search(pattern, filter)
+	}
+	return pattern, filter, results, err
+}
@@ -1,13 +1,24 @@
 package reindex
 
 import (
+	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/evanj/csearch/grep"
+	"github.com/evanj/csearch/lang"
+	"github.com/google/codesearch/index"
 )
 
+func indexAll(path string, info os.FileInfo) bool {
+	return true
+}
+
 func TestSearch(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "search_test")
 	if err != nil {
@@ -30,7 +41,7 @@ func TestSearch(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	f3Path := filepath.Join(tempDir2, "f3")
+	f3Path := filepath.Join(tempDir2, "f3.py")
 	err = ioutil.WriteFile(f3Path, []byte("hello world f3\nfoo bar\n"), 0700)
 	if err != nil {
 		t.Fatal(err)
@@ -41,19 +52,20 @@ func TestSearch(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = IndexTree(writer, tempDir)
+	err = IndexTree(writer, tempDir, indexAll)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = IndexTree(writer, tempDir2)
+	err = IndexTree(writer, tempDir2, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := FlushAndReopen(writer)
 	if err != nil {
 		t.Fatal(err)
 	}
-	writer.Flush()
-
-	index := FlushAndReopen(writer, indexPath)
 
-	results, err := Search(index, " f1", "")
+	results, err := Search(index, " f1", Filter{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -70,18 +82,220 @@ func TestSearch(t *testing.T) {
 		t.Error(*results[0])
 	}
 
-	results, err = Search(index, "foo", "")
+	results, err = Search(index, "foo", Filter{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(results) != 3 {
 		t.Error(results)
 	}
-	results, err = Search(index, "foo", "f1$")
+	results, err = Search(index, "foo", Filter{File: "f1$"})
 	if err != nil {
 		t.Fatal(err)
 	}
 	if len(results) != 1 {
 		t.Error(results)
 	}
+
+	results, err = Search(index, "foo", Filter{Langs: []string{lang.Python}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Lang != lang.Python {
+		t.Error(results)
+	}
+	results, err = Search(index, "foo", Filter{Roots: []string{tempDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Error(results)
+	}
+
+	// languages are stored alongside the index
+	index, err = Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err = Search(index, "foo", Filter{Langs: []string{lang.Python, lang.Go}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !strings.HasSuffix(results[0].Path, "/f3.py") {
+		t.Error(results)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		q        string
+		expected string
+		filter   Filter
+	}{
+		{"foo bar", "foo bar", Filter{}},
+		{"lang:go foo bar", "foo bar", Filter{Langs: []string{"go"}}},
+		{"lang:go  lang:c++ foo", "foo", Filter{Langs: []string{"go", "c++"}}},
+		{"lang:go", "", Filter{Langs: []string{"go"}}},
+		{"foo lang:go", "foo lang:go", Filter{}},
+		{"dir:src ext:.go root:/a/b lang: x", "x",
+			Filter{Langs: []string{""}, Dirs: []string{"src"}, Exts: []string{".go"}, Roots: []string{"/a/b"}}},
+		{`root:"/a/my project" dir:"x y"  dir:"\"q" dir:a"b foo`, "foo",
+			Filter{Dirs: []string{"x y", `"q`, `a"b`}, Roots: []string{"/a/my project"}}},
+		{`dir:"x y`, `dir:"x y`, Filter{}},
+		{`dir:"x"y foo`, `dir:"x"y foo`, Filter{}},
+	}
+	for _, test := range tests {
+		q, filter := ParseQuery(test.q)
+		if q != test.expected || !reflect.DeepEqual(filter, test.filter) {
+			t.Errorf("ParseQuery(%#v)=%#v, %#v; expected %#v, %#v", test.q, q, filter, test.expected, test.filter)
+		}
+		pattern, filter := ParseQuery(FormatQuery(q, filter))
+		if pattern != q || !reflect.DeepEqual(filter, test.filter) {
+			t.Errorf("FormatQuery(%#v, %#v) did not round trip", q, test.filter)
+		}
+	}
+}
+
+func TestFacets(t *testing.T) {
+	ix := &Index{roots: []string{"/a", "/b/", "/a/c"}}
+	results := []*Result{
+		{&grep.Match{Path: "/a/src/x.go"}, lang.Go},
+		{&grep.Match{Path: "/a/src/x.go"}, lang.Go},
+		{&grep.Match{Path: "/a/src/y/z.go"}, lang.Go},
+		{&grep.Match{Path: "/a/Makefile"}, lang.Make},
+		{&grep.Match{Path: "/b/lib/z.py"}, lang.Python},
+		{&grep.Match{Path: "/a/c/d/e.py"}, lang.Python},
+	}
+	facets := CountFacets(ix, results)
+	expected := &Facets{
+		Dirs:  []FacetCount{{"src", 2}, {"", 1}, {"d", 1}, {"lib", 1}},
+		Exts:  []FacetCount{{".go", 2}, {".py", 2}, {"", 1}},
+		Langs: []FacetCount{{lang.Go, 2}, {lang.Python, 2}, {lang.Make, 1}},
+		Roots: []FacetCount{{"/a", 3}, {"/a/c", 1}, {"/b/", 1}},
+	}
+	if !reflect.DeepEqual(facets, expected) {
+		t.Errorf("unexpected facets %v; expected %v", facets, expected)
+	}
+
+	filter, err := Filter{Dirs: []string{"src", "lib"}, Exts: []string{".go", ".py"}}.compile(ix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		expected := r.Path != "/a/Makefile" && r.Path != "/a/c/d/e.py"
+		if filter.match(r.Path, r.Lang) != expected {
+			t.Errorf("%s: expected match=%t", r.Path, expected)
+		}
+	}
+}
+
+func TestSearchEncodings(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "search_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	files := map[string]string{
+		"bom.txt":    "\xef\xbb\xbfcafé bom\n",
+		"latin1.txt": "first\ncaf\xe9 latin1\n",
+		"utf16.txt":  "\xff\xfec\x00a\x00f\x00\xe9\x00 \x00u\x00t\x00f\x001\x006\x00\n\x00",
+		"utf8.txt":   "café utf8\n",
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the encodings are stored alongside the index
+	index, err := Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := map[string]string{}
+	for i := 0; i < index.NumNames(); i++ {
+		encodings[filepath.Base(index.Name(uint32(i)))] = index.Encoding(uint32(i))
+	}
+	expectedEncodings := map[string]string{
+		"bom.txt":    "utf-8-bom",
+		"latin1.txt": "windows-1252",
+		"utf16.txt":  "utf-16le",
+		"utf8.txt":   "",
+	}
+	if !reflect.DeepEqual(encodings, expectedEncodings) {
+		t.Errorf("encodings=%v; expected %v", encodings, expectedEncodings)
+	}
+
+	// the index and the matches are in UTF-8
+	results, err := Search(index, "^café [a-z]", Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, r := range results {
+		lines = append(lines, filepath.Base(r.Path)+":"+r.Line[r.Start:r.End]+":"+r.Line[r.End:])
+	}
+	expected := []string{"bom.txt:café b:om", "latin1.txt:café l:atin1", "utf16.txt:café u:tf16", "utf8.txt:café u:tf8"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("results=%v; expected %v", lines, expected)
+	}
+}
+
+// binaryReader reads size bytes of a fake binary file, counting the bytes read.
+type binaryReader struct {
+	size, offset, read int64
+}
+
+func (r *binaryReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.size-r.offset {
+		p = p[:r.size-r.offset]
+	}
+	for i := range p {
+		p[i] = byte((r.offset + int64(i)) * 131)
+	}
+	r.offset += int64(len(p))
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func (r *binaryReader) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return 0, errors.New("unsupported seek")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func TestSkipLargeBinary(t *testing.T) {
+	writer := &Writer{}
+	e := &index.Extractor{MaxFileLen: 1 << 30, MaxLineLen: 2000, MaxTextTrigrams: 20000}
+	r := &binaryReader{size: 512 << 20}
+	file := &indexedFile{path: "large.bin"}
+	writer.extractReader(e, file, r, r.size)
+	err := file.err
+	if skipErr, ok := err.(*index.SkipError); !ok || skipErr.Reason != index.SkipInvalidUTF8 {
+		t.Errorf("expected invalid UTF-8: %v", err)
+	}
+	if r.read > 1<<20 {
+		t.Errorf("read %d bytes of a binary file", r.read)
+	}
 }
@@ -0,0 +1,593 @@
+package reindex
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/evanj/csearch/atomicfile"
+	"github.com/evanj/csearch/symbol"
+)
+
+// Ways to divide files between the shards of a sharded index.
+const (
+	// One shard for each tree passed to IndexShardedTree.
+	ShardByRoot = "root"
+	// A fixed number of shards, chosen by a hash of each file's path.
+	ShardByHash = "hash"
+)
+
+// ShardsPath returns the path of the list of shards of the sharded index at indexPath. Indexes
+// without the list are a single index file at indexPath.
+func ShardsPath(indexPath string) string {
+	return indexPath + ".shards"
+}
+
+// ShardPath returns the path of shard i of generation of the sharded index at indexPath.
+func ShardPath(indexPath string, generation int, i int) string {
+	return fmt.Sprintf("%s.shard%d", generationPath(indexPath, generation), i)
+}
+
+// generationPath returns the path that the files of generation of the sharded index at
+// indexPath start with. Each time the index is replaced, the files of the new one are written
+// to the next generation, so they do not overwrite files that are still listed.
+func generationPath(indexPath string, generation int) string {
+	return fmt.Sprintf("%s.%d", indexPath, generation)
+}
+
+// The list of shards stored in ShardsPath. Replacing it replaces the whole index.
+type shardList struct {
+	By         string `json:"by"`
+	Generation int    `json:"generation,omitempty"`
+	// file names in the directory of the index
+	Shards []string `json:"shards"`
+	// the file name of the symbol table, or empty for SymbolPath of the index
+	Symbols string `json:"symbols,omitempty"`
+}
+
+// readShardList reads the list of shards of the index at indexPath. It returns nil if the
+// index is not sharded.
+func readShardList(indexPath string) (*shardList, error) {
+	data, err := ioutil.ReadFile(ShardsPath(indexPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list shardList
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", ShardsPath(indexPath), err.Error())
+	}
+	if len(list.Shards) == 0 {
+		return nil, fmt.Errorf("%s: no shards", ShardsPath(indexPath))
+	}
+	return &list, nil
+}
+
+// ShardedWriter creates a sharded index: a set of indexes that are searched together.
+type ShardedWriter struct {
+	// Workers is the number of files IndexShardedTrees reads at once; 0 means GOMAXPROCS.
+	// SetMemoryBudget can limit it.
+	Workers int
+	// If not nil, Progress is called like Writer.Progress.
+	Progress func(Progress)
+	path     string
+	by       string
+	// the generation of the new shards: one more than the existing index
+	generation int
+	shards     []*Writer
+	limits     []TextLimits
+	// set by SetMemoryBudget: the memory for the trigrams of all shards, or 0 for each shard to
+	// use the default, and the limit on Workers, or 0 for no limit
+	memory     int64
+	maxWorkers int
+}
+
+// CreateSharded starts writing a sharded index at indexPath. by is ShardByRoot to create a shard
+// for each tree, or ShardByHash to divide the files between n shards. The shards are written to
+// new files, and any existing index stays in place until FlushAndReopenSharded replaces the
+// list of shards.
+func CreateSharded(indexPath string, by string, n int) (*ShardedWriter, error) {
+	w := &ShardedWriter{path: indexPath, by: by, generation: 1}
+	// a list that cannot be read is replaced like any other
+	list, _ := readShardList(indexPath)
+	if list != nil {
+		w.generation = list.Generation + 1
+	}
+	switch by {
+	case ShardByRoot:
+	case ShardByHash:
+		if n < 1 {
+			return nil, fmt.Errorf("invalid number of shards: %d", n)
+		}
+		for i := 0; i < n; i++ {
+			err := w.addShard()
+			if err != nil {
+				w.Discard()
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown shard type: %#v", by)
+	}
+	return w, nil
+}
+
+func (w *ShardedWriter) addShard() error {
+	shard, err := Create(ShardPath(w.path, w.generation, len(w.shards)))
+	if err != nil {
+		return err
+	}
+	shard.SetTextLimits(w.limits)
+	w.shards = append(w.shards, shard)
+	return nil
+}
+
+// SetTextLimits sets the limits of every shard, like Writer.SetTextLimits.
+func (w *ShardedWriter) SetTextLimits(limits []TextLimits) {
+	w.limits = limits
+	for _, shard := range w.shards {
+		shard.SetTextLimits(limits)
+	}
+}
+
+// SetMemoryBudget sets the memory used to index files: the workers that read files use
+// index.ExtractorMemory each, and the rest holds the trigrams of the files until they are
+// written to temporary files (see index.IndexWriter.SetMemoryBudget). The workers get at most
+// half of the budget, so it can reduce Workers, which should be set first; with the default
+// budget, there is no limit. The rest is divided between the shards: with ShardByHash between
+// all the shards, and with ShardByRoot between the trees of each call to IndexShardedTrees. The
+// budget does not cover the files being read, or the other information kept for each file. It
+// must be called before adding files.
+func (w *ShardedWriter) SetMemoryBudget(bytes int64) {
+	w.maxWorkers, w.memory = splitMemoryBudget(bytes, w.Workers)
+	for _, shard := range w.shards {
+		shard.IndexWriter.SetMemoryBudget(w.memory / int64(len(w.shards)))
+	}
+}
+
+// Discard removes the partially written shards, leaving any existing index in place.
+func (w *ShardedWriter) Discard() error {
+	var err error
+	for _, shard := range w.shards {
+		shardErr := shard.Discard()
+		if err == nil {
+			err = shardErr
+		}
+	}
+	return err
+}
+
+// IndexShardedTree adds the files in tree to w, like IndexTree.
+func IndexShardedTree(w *ShardedWriter, tree string, shouldIndex func(string, os.FileInfo) bool) error {
+	return IndexShardedTrees(w, []string{tree}, shouldIndex)
+}
+
+// IndexShardedTrees adds the files in trees to w, like IndexTrees.
+func IndexShardedTrees(w *ShardedWriter, trees []string, shouldIndex func(string, os.FileInfo) bool) error {
+	workers := limitWorkers(w.Workers, w.maxWorkers)
+	if w.by == ShardByRoot {
+		first := len(w.shards)
+		for _, tree := range trees {
+			err := w.addShard()
+			if err != nil {
+				return err
+			}
+			shard := w.shards[len(w.shards)-1]
+			shard.AddPaths([]string{tree})
+			if w.memory > 0 {
+				shard.IndexWriter.SetMemoryBudget(w.memory / int64(len(trees)))
+			}
+		}
+		return indexTrees(trees, shouldIndex, workers, w.Progress, func(tree int, path string) *Writer {
+			return w.shards[first+tree]
+		})
+	}
+
+	// every shard can have files from every tree
+	for _, shard := range w.shards {
+		shard.AddPaths(trees)
+	}
+	return indexTrees(trees, shouldIndex, workers, w.Progress, func(tree int, path string) *Writer {
+		h := fnv.New32a()
+		h.Write([]byte(path))
+		return w.shards[h.Sum32()%uint32(len(w.shards))]
+	})
+}
+
+// FlushAndReopenSharded finishes the shards in parallel and writes the symbols of all of them,
+// then replaces any existing index at the writer's path with them and opens them. The index is
+// replaced by renaming the new list of shards over the old one: OpenSharded opens either the
+// whole old index or the whole new one.
+func FlushAndReopenSharded(w *ShardedWriter) (*ShardedIndex, error) {
+	if len(w.shards) == 0 {
+		// sharded by root without any trees
+		err := w.addShard()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]string, len(w.shards))
+	shards := make([]*Index, len(w.shards))
+	errs := make([]error, len(w.shards))
+	var wg sync.WaitGroup
+	for i, shard := range w.shards {
+		paths[i] = shard.path
+		wg.Add(1)
+		go func(i int, shard *Writer) {
+			defer wg.Done()
+			shards[i], errs[i] = flushAndReopen(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	ix := newShardedIndex(paths, shards)
+	err := firstError(errs)
+	if err == nil {
+		var symbols []*symbol.Symbol
+		for _, shard := range w.shards {
+			symbols = append(symbols, shard.symbols...)
+		}
+		ix.symbols, err = writeSymbols(symbols, ix.NumNames(), generationPath(w.path, w.generation))
+	}
+	if err == nil {
+		err = w.replaceIndex(paths)
+	}
+	if err != nil {
+		ix.Close()
+		// nothing lists the new files yet
+		for _, path := range paths {
+			removeIndex(path)
+		}
+		os.Remove(SymbolPath(generationPath(w.path, w.generation)))
+		return nil, err
+	}
+	return ix, nil
+}
+
+// replaceIndex writes the list of the new shards at paths over the existing one, then removes
+// the files of the previous index. Once the list is written, the new index is in use: failing
+// to remove a file is logged rather than returned.
+func (w *ShardedWriter) replaceIndex(paths []string) error {
+	dir := filepath.Dir(w.path)
+	previous, _ := readShardList(w.path)
+	list := shardList{By: w.by, Generation: w.generation,
+		Symbols: filepath.Base(SymbolPath(generationPath(w.path, w.generation)))}
+	listed := map[string]bool{}
+	for _, path := range paths {
+		list.Shards = append(list.Shards, filepath.Base(path))
+		listed[path] = true
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(ShardsPath(w.path), append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	// an index that was not sharded, and the files of version 1 indexes
+	oldIndexes := []string{w.path}
+	oldFiles := []string{SymbolPath(w.path), LangPath(w.path), EncodingPath(w.path)}
+	if previous != nil {
+		for _, name := range previous.Shards {
+			oldIndexes = append(oldIndexes, filepath.Join(dir, name))
+		}
+		if previous.Symbols != "" {
+			oldFiles = append(oldFiles, filepath.Join(dir, previous.Symbols))
+		}
+	}
+	for _, path := range oldIndexes {
+		if listed[path] {
+			continue
+		}
+		_, err := removeIndex(path)
+		if err != nil {
+			log.Printf("removing the previous index: %s", err.Error())
+		}
+	}
+	for _, path := range oldFiles {
+		if path == SymbolPath(generationPath(w.path, w.generation)) {
+			continue
+		}
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("removing the previous index: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// removeIndex removes the index at indexPath and its list of skipped files. It returns false
+// if the index does not exist.
+func removeIndex(indexPath string) (bool, error) {
+	err := os.Remove(indexPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.Remove(SkippedPath(indexPath))
+	if err != nil && !os.IsNotExist(err) {
+		return true, err
+	}
+	return true, nil
+}
+
+// ShardedIndex is a set of indexes that are searched together. Searches query and grep the
+// shards in parallel, and return results in the same order as a single index of the same trees.
+type ShardedIndex struct {
+	paths  []string
+	shards []*Index
+	// the indexed paths of all shards, in the order they were indexed
+	roots   []string
+	symbols *symbol.Table
+}
+
+func newShardedIndex(paths []string, shards []*Index) *ShardedIndex {
+	ix := &ShardedIndex{paths: paths, shards: shards, symbols: symbol.NewTable(nil)}
+	seen := map[string]bool{}
+	for _, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		for _, root := range shard.roots {
+			if !seen[root] {
+				seen[root] = true
+				ix.roots = append(ix.roots, root)
+			}
+		}
+	}
+	return ix
+}
+
+// OpenSharded opens the sharded index at indexPath and its symbols. An index that is not
+// sharded is opened as a single shard.
+func OpenSharded(indexPath string) (*ShardedIndex, error) {
+	list, err := readShardList(indexPath)
+	for err == nil {
+		ix, openErr := openShards(indexPath, list)
+		if !os.IsNotExist(openErr) {
+			return ix, openErr
+		}
+		// the index may have been replaced, and its files removed, after the list was read
+		var current *shardList
+		current, err = readShardList(indexPath)
+		if err == nil && reflect.DeepEqual(current, list) {
+			return nil, openErr
+		}
+		list = current
+	}
+	return nil, err
+}
+
+// openShards opens the shards in list, or the index at indexPath if list is nil.
+func openShards(indexPath string, list *shardList) (*ShardedIndex, error) {
+	if list == nil {
+		ix, err := Open(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		sharded := newShardedIndex([]string{indexPath}, []*Index{ix})
+		sharded.symbols, err = OpenSymbols(indexPath)
+		if err != nil {
+			sharded.Close()
+			return nil, err
+		}
+		return sharded, nil
+	}
+
+	dir := filepath.Dir(indexPath)
+	paths := make([]string, len(list.Shards))
+	shards := make([]*Index, len(list.Shards))
+	for i, name := range list.Shards {
+		paths[i] = filepath.Join(dir, name)
+		var err error
+		shards[i], err = Open(paths[i])
+		if err != nil {
+			newShardedIndex(paths, shards).Close()
+			return nil, err
+		}
+	}
+	sharded := newShardedIndex(paths, shards)
+	var err error
+	if list.Symbols == "" {
+		sharded.symbols, err = OpenSymbols(indexPath)
+	} else {
+		// unlike OpenSymbols, fails if the table was removed
+		sharded.symbols, err = symbol.ReadTable(filepath.Join(dir, list.Symbols))
+	}
+	if err != nil {
+		sharded.Close()
+		return nil, err
+	}
+	return sharded, nil
+}
+
+// Shards returns the indexes in the set.
+func (ix *ShardedIndex) Shards() []*Index {
+	return ix.shards
+}
+
+// Symbols returns the symbols defined in the files of all shards.
+func (ix *ShardedIndex) Symbols() *symbol.Table {
+	return ix.symbols
+}
+
+// ShardPaths returns the paths of the index files in the set.
+func (ix *ShardedIndex) ShardPaths() []string {
+	return ix.paths
+}
+
+// NumNames returns the number of files in all shards.
+func (ix *ShardedIndex) NumNames() int {
+	n := 0
+	for _, shard := range ix.shards {
+		n += shard.NumNames()
+	}
+	return n
+}
+
+// Paths returns the indexed paths, in the order they were indexed.
+func (ix *ShardedIndex) Paths() []string {
+	return append([]string(nil), ix.roots...)
+}
+
+// Root returns the indexed path that contains filepath, or "" if there is none.
+func (ix *ShardedIndex) Root(filepath string) string {
+	return findRoot(ix.roots, filepath)
+}
+
+// Skipped returns the files that were not indexed by any shard, in the order they were found.
+func (ix *ShardedIndex) Skipped() []Skipped {
+	var skipped []Skipped
+	for _, shard := range ix.shards {
+		skipped = append(skipped, shard.Skipped()...)
+	}
+	ix.sortByPath(skipped, func(i int) string {
+		return skipped[i].Path
+	})
+	return skipped
+}
+
+// Close closes all shards.
+func (ix *ShardedIndex) Close() error {
+	var err error
+	for _, shard := range ix.shards {
+		if shard == nil {
+			continue
+		}
+		shardErr := shard.Close()
+		if err == nil {
+			err = shardErr
+		}
+	}
+	return err
+}
+
+// Verify checks all shards in parallel, like index.Index.Verify.
+func (ix *ShardedIndex) Verify() error {
+	return ix.eachShard(func(i int, shard *Index) error {
+		return shard.Verify()
+	})
+}
+
+// eachShard calls f for every shard in parallel. It returns the error of the first shard that
+// failed, including an *index.CorruptError if f finds invalid data.
+func (ix *ShardedIndex) eachShard(f func(i int, shard *Index) error) error {
+	errs := make([]error, len(ix.shards))
+	var wg sync.WaitGroup
+	for i, shard := range ix.shards {
+		wg.Add(1)
+		go func(i int, shard *Index) {
+			defer wg.Done()
+			// a panic here would end the process
+			defer shard.CatchCorrupt(&errs[i])
+			errs[i] = f(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	return firstError(errs)
+}
+
+// firstError returns the first error in errs that is not nil.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchShards runs search on every shard in parallel, and merges the results.
+func (ix *ShardedIndex) searchShards(search func(*Index) ([]*Result, error)) ([]*Result, error) {
+	shardResults := make([][]*Result, len(ix.shards))
+	err := ix.eachShard(func(i int, shard *Index) error {
+		var err error
+		shardResults[i], err = search(shard)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*Result
+	for _, r := range shardResults {
+		results = append(results, r...)
+	}
+	ix.sortByPath(results, func(i int) string {
+		return results[i].Path
+	})
+	return results, nil
+}
+
+func (ix *ShardedIndex) search(qString string, filter Filter) ([]*Result, error) {
+	return ix.searchShards(func(shard *Index) ([]*Result, error) {
+		return Search(shard, qString, filter)
+	})
+}
+
+func (ix *ShardedIndex) searchIdent(kind string, name string, filter Filter) ([]*Result, error) {
+	return ix.searchShards(func(shard *Index) ([]*Result, error) {
+		return SearchIdent(shard, kind, name, filter)
+	})
+}
+
+// sortByPath stably sorts slice, where path returns the path of element i, in the order that
+// a single index lists files: by the order their roots were indexed, then in filepath.Walk
+// order. The elements for each file stay in the order of the shard that has it.
+func (ix *ShardedIndex) sortByPath(slice interface{}, path func(i int) string) {
+	if len(ix.shards) < 2 {
+		return
+	}
+	rootOrder := map[string]int{}
+	for i, root := range ix.roots {
+		rootOrder[root] = i
+	}
+	sort.SliceStable(slice, func(i, j int) bool {
+		a, b := path(i), path(j)
+		if a == b {
+			return false
+		}
+		rootA, rootB := rootOrder[ix.Root(a)], rootOrder[ix.Root(b)]
+		if rootA != rootB {
+			return rootA < rootB
+		}
+		return walkLess(a, b)
+	})
+}
+
+// walkLess returns true if filepath.Walk visits a before b: it compares the paths one element
+// at a time, since the entries of each directory are visited in lexical order.
+func walkLess(a, b string) bool {
+	for a != b {
+		elemA, restA := splitFirst(a)
+		elemB, restB := splitFirst(b)
+		if elemA != elemB {
+			return elemA < elemB
+		}
+		a, b = restA, restB
+	}
+	return false
+}
+
+func splitFirst(path string) (string, string) {
+	i := strings.IndexRune(path, filepath.Separator)
+	if i < 0 {
+		return path, ""
+	}
+	return path[:i], path[i+1:]
+}
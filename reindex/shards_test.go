@@ -0,0 +1,240 @@
+package reindex
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/evanj/csearch/symbol"
+	"github.com/google/codesearch/index"
+)
+
+func resultLocations(results []*Result) []string {
+	var out []string
+	for _, r := range results {
+		out = append(out, fmt.Sprintf("%s:%d", r.Path, r.LineNumber))
+	}
+	return out
+}
+
+func TestShardedIndex(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shards_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// roots are not indexed in lexical order, and x.txt sorts before x/ but is walked after it
+	files := []string{"b/x.txt", "b/x/y.txt", "b/z.txt", "a/1.txt", "a/2.txt", "a/sub/3.txt", "a/sub/4.txt"}
+	for i, name := range files {
+		path := filepath.Join(tempDir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, []byte(fmt.Sprintf("hello %d\nother\nhello again\n", i)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(tempDir, "a/long.txt"), []byte(strings.Repeat("x", 3000)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := []string{filepath.Join(tempDir, "b"), filepath.Join(tempDir, "a")}
+	indexDir := filepath.Join(tempDir, "index")
+	err = os.Mkdir(indexDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexPath := filepath.Join(indexDir, ".index")
+
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range roots {
+		err = IndexTree(writer, root, indexAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	single, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	symbols := symbol.NewTable(nil)
+	_, _, expected, err := SearchQuery(single, symbols, "hello", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expected) != 2*len(files) {
+		t.Fatalf("single index: %d results; expected %d", len(expected), 2*len(files))
+	}
+
+	tests := []struct {
+		by     string
+		n      int
+		shards []string
+	}{
+		{ShardByHash, 3, []string{".index.1.shard0", ".index.1.shard1", ".index.1.shard2"}},
+		{ShardByRoot, 0, []string{".index.2.shard0", ".index.2.shard1"}},
+		{ShardByHash, 1, []string{".index.3.shard0"}},
+	}
+	for i, test := range tests {
+		previousList, err := readShardList(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer, err := CreateSharded(indexPath, test.by, test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, root := range roots {
+			err = IndexShardedTree(writer, root, indexAll)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the new shards do not replace any file of the previous index until they are listed
+		previous, err := OpenSharded(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if previous.NumNames() != single.NumNames() {
+			t.Errorf("%s %d: previous index has %d files", test.by, test.n, previous.NumNames())
+		}
+		previous.Close()
+		written, err := FlushAndReopenSharded(writer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written.Close()
+
+		// only the new shards are left
+		infos, err := ioutil.ReadDir(indexDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		var expectedNames []string
+		for _, name := range test.shards {
+			expectedNames = append(expectedNames, name, name+".skipped")
+		}
+		expectedNames = append(expectedNames, fmt.Sprintf(".index.%d.symbols", i+1), ".index.shards")
+		if !reflect.DeepEqual(names, expectedNames) {
+			t.Errorf("%s %d: index files %v; expected %v", test.by, test.n, names, expectedNames)
+		}
+		// a reader that read the previous list before it was replaced opens the new index
+		_, err = openShards(indexPath, previousList)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s %d: opening the previous shards: %v", test.by, test.n, err)
+		}
+
+		ix, err := OpenSharded(indexPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ix.Shards()) != len(test.shards) {
+			t.Errorf("%s %d: %d shards; expected %d", test.by, test.n, len(ix.Shards()), len(test.shards))
+		}
+		if ix.NumNames() != single.NumNames() || !reflect.DeepEqual(ix.Paths(), roots) {
+			t.Errorf("%s %d: NumNames()=%d Paths()=%v; expected %d %v",
+				test.by, test.n, ix.NumNames(), ix.Paths(), single.NumNames(), roots)
+		}
+		if !reflect.DeepEqual(ix.Skipped(), single.Skipped()) {
+			t.Errorf("%s %d: Skipped()=%v; expected %v", test.by, test.n, ix.Skipped(), single.Skipped())
+		}
+		err = ix.Verify()
+		if err != nil {
+			t.Errorf("%s %d: Verify()=%s", test.by, test.n, err.Error())
+		}
+
+		_, _, results, err := SearchQuery(ix, symbols, "hello", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resultLocations(results), resultLocations(expected)) {
+			t.Errorf("%s %d: results %v; expected %v",
+				test.by, test.n, resultLocations(results), resultLocations(expected))
+		}
+		_, _, results, err = SearchQuery(ix, symbols, "dir:sub hello", "", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 4 {
+			t.Errorf("%s %d: %d results in dir:sub; expected 4", test.by, test.n, len(results))
+		}
+		ix.Close()
+	}
+}
+
+func TestWalkLess(t *testing.T) {
+	ordered := []string{"/a/b", "/a/b/c", "/a/b.txt", "/a/ba", "/a/c"}
+	for i := range ordered {
+		for j := range ordered {
+			if walkLess(ordered[i], ordered[j]) != (i < j) {
+				t.Errorf("walkLess(%#v, %#v)=%v", ordered[i], ordered[j], !(i < j))
+			}
+		}
+	}
+}
+
+func TestShardedIndexCorrupt(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shards_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	for i := 0; i < 10; i++ {
+		err = ioutil.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%d.txt", i)), []byte("hello\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := CreateSharded(indexPath, ShardByHash, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexShardedTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := FlushAndReopenSharded(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix.Close()
+
+	// a zero delta in the posting list for "hel" in one shard is only found when searching
+	shardPath := ix.ShardPaths()[1]
+	data, err := ioutil.ReadFile(shardPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(data, []byte("hel"))
+	data[i+3] = 0
+	err = ioutil.WriteFile(shardPath, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err = OpenSharded(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	_, _, _, err = SearchQuery(ix, ix.Symbols(), "hello", "", 0)
+	if _, ok := err.(*index.CorruptError); !ok {
+		t.Errorf("expected a CorruptError: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package reindex
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/evanj/csearch/atomicfile"
+	"github.com/google/codesearch/index"
+)
+
+// Skipped is a file that was found while indexing but is not in the index.
+type Skipped struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// Line where the problem was found, starting at 1; 0 if it applies to the whole file
+	Line int `json:"line,omitempty"`
+	// The error that caused a read error
+	Error string `json:"error,omitempty"`
+}
+
+// SkippedPath returns the path of the skipped files list stored alongside the index at indexPath.
+func SkippedPath(indexPath string) string {
+	return indexPath + ".skipped"
+}
+
+func newSkipped(err *index.SkipError) Skipped {
+	s := Skipped{Path: err.Name, Reason: string(err.Reason), Line: err.Line}
+	if err.Err != nil {
+		s.Error = err.Err.Error()
+	}
+	return s
+}
+
+func writeSkipped(path string, skipped []Skipped) error {
+	if skipped == nil {
+		// write an empty list rather than null
+		skipped = []Skipped{}
+	}
+	data, err := json.MarshalIndent(skipped, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, append(data, '\n'))
+}
+
+// Returns nil if the list does not exist, since older indexes were created without one.
+func readSkipped(path string) ([]Skipped, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var skipped []Skipped
+	err = json.Unmarshal(data, &skipped)
+	if err != nil {
+		return nil, err
+	}
+	return skipped, nil
+}
@@ -0,0 +1,77 @@
+package reindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSkipped(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "skipped_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	files := map[string]string{
+		"a_ok.txt":      "hello world\n",
+		"b_long.json":   "{}\n{\"k\": \"" + strings.Repeat("x", 3000) + "\"}\n",
+		"c_binary.dat":  "line one\n\x00\xff\xfe\x01\n",
+		"d_another.txt": "another\n",
+	}
+	for name, data := range files {
+		err = ioutil.WriteFile(filepath.Join(tempDir, name), []byte(data), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexPath := filepath.Join(tempDir, ".index")
+	writer, err := Create(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = IndexTree(writer, tempDir, indexAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := FlushAndReopen(writer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Skipped{
+		{Path: filepath.Join(tempDir, "b_long.json"), Reason: "line too long", Line: 2},
+		{Path: filepath.Join(tempDir, "c_binary.dat"), Reason: "invalid UTF-8", Line: 2},
+	}
+	if !reflect.DeepEqual(ix.Skipped(), expected) {
+		t.Errorf("Skipped()=%v; expected %v", ix.Skipped(), expected)
+	}
+	if ix.NumNames() != 2 {
+		t.Errorf("NumNames()=%d; expected 2", ix.NumNames())
+	}
+
+	reopened, err := Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.Skipped(), expected) {
+		t.Errorf("reopened Skipped()=%v; expected %v", reopened.Skipped(), expected)
+	}
+
+	// indexes without the list can still be opened
+	err = os.Remove(SkippedPath(indexPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err = Open(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Skipped() != nil {
+		t.Errorf("Skipped()=%v; expected nil", reopened.Skipped())
+	}
+}
@@ -0,0 +1,54 @@
+package reindex
+
+import (
+	"log"
+	"os"
+
+	"github.com/evanj/csearch/symbol"
+)
+
+// SymbolPath returns the path of the symbol table stored alongside the index at indexPath.
+func SymbolPath(indexPath string) string {
+	return indexPath + ".symbols"
+}
+
+func writeSymbols(symbols []*symbol.Symbol, files int, indexPath string) (*symbol.Table, error) {
+	log.Printf("%d symbols in %d files", len(symbols), files)
+
+	table := symbol.NewTable(symbols)
+	err := table.Write(SymbolPath(indexPath))
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// OpenSymbols reads the symbol table written by FlushAndReopen. It returns an empty table if
+// the index was created without one.
+func OpenSymbols(indexPath string) (*symbol.Table, error) {
+	table, err := symbol.ReadTable(SymbolPath(indexPath))
+	if os.IsNotExist(err) {
+		return symbol.NewTable(nil), nil
+	}
+	return table, err
+}
+
+// SearchSymbols returns up to limit definitions of symbols matching query, in files that
+// match filter. If limit <= 0, it returns all matches.
+func SearchSymbols(ix Searcher, table *symbol.Table, query string, filter Filter, limit int) ([]*Result, error) {
+	compiledFilter, err := filter.compile(ix)
+	if err != nil {
+		return nil, err
+	}
+	var results []*Result
+	for _, s := range table.Match(query, 0) {
+		if !compiledFilter.match(s.Path, s.Lang) {
+			continue
+		}
+		results = append(results, &Result{s.ToMatch(), s.Lang})
+		if len(results) == limit {
+			break
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,282 @@
+// Package symbol extracts definitions of functions, types and methods from source files
+package symbol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/evanj/csearch/atomicfile"
+	"github.com/evanj/csearch/grep"
+	"github.com/evanj/csearch/lang"
+)
+
+// Kinds of symbols
+const (
+	KindFunc   = "func"
+	KindMethod = "method"
+	KindType   = "type"
+	KindClass  = "class"
+)
+
+type Symbol struct {
+	Name       string
+	Kind       string
+	Parent     string // enclosing type for methods; empty otherwise
+	Lang       string
+	Path       string
+	LineNumber int
+	Line       string
+	// Byte offset of Name in Line
+	Start int
+}
+
+// QualifiedName returns Parent.Name for methods, or Name otherwise.
+func (s *Symbol) QualifiedName() string {
+	if s.Parent == "" {
+		return s.Name
+	}
+	return s.Parent + "." + s.Name
+}
+
+// ToMatch returns the symbol's definition as a grep result, with the name as the match.
+func (s *Symbol) ToMatch() *grep.Match {
+	start := s.Start
+	end := start + len(s.Name)
+	if end > len(s.Line) || s.Line[start:end] != s.Name {
+		// tables written without the offset: use the first occurrence
+		start = strings.Index(s.Line, s.Name)
+		end = start + len(s.Name)
+		if start < 0 {
+			start = 0
+			end = 0
+		}
+	}
+	return &grep.Match{Path: s.Path, LineNumber: s.LineNumber, Line: s.Line, Start: start, End: end}
+}
+
+// Supported reports whether Extract finds symbols in files in language fileLang.
+func Supported(fileLang string) bool {
+	return fileLang == lang.Go || len(rulesByLang[fileLang]) > 0
+}
+
+// Extract returns the symbols defined in data, which is the contents of the file at path
+// in language fileLang (see package lang). It returns nil for files in languages it does
+// not understand, or that cannot be parsed.
+func Extract(filepath string, fileLang string, data []byte) []*Symbol {
+	if fileLang == lang.Go {
+		return extractGo(filepath, data)
+	}
+	rules := rulesByLang[fileLang]
+	if len(rules) == 0 {
+		return nil
+	}
+	return extractRules(filepath, fileLang, data, rules)
+}
+
+func extractGo(filepath string, data []byte) []*Symbol {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, filepath, data, parser.SkipObjectResolution)
+	if err != nil {
+		// parser returns a partial AST for files with errors; ignore them for simplicity
+		return nil
+	}
+
+	lines := bytes.Split(data, []byte("\n"))
+	var symbols []*Symbol
+	add := func(ident *ast.Ident, kind string, parent string) {
+		p := fset.PositionFor(ident.Pos(), false)
+		symbols = append(symbols, &Symbol{ident.Name, kind, parent, lang.Go, filepath, p.Line,
+			string(lines[p.Line-1]), p.Column - 1})
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil || len(d.Recv.List) == 0 {
+				add(d.Name, KindFunc, "")
+			} else {
+				add(d.Name, KindMethod, receiverName(d.Recv.List[0].Type))
+			}
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				add(spec.(*ast.TypeSpec).Name, KindType, "")
+			}
+		}
+	}
+	return symbols
+}
+
+// receiverName returns the name of the type in a method receiver: T, *T, T[K] or *T[K].
+func receiverName(expr ast.Expr) string {
+	for {
+		switch e := expr.(type) {
+		case *ast.StarExpr:
+			expr = e.X
+		case *ast.IndexExpr:
+			expr = e.X
+		case *ast.IndexListExpr:
+			expr = e.X
+		case *ast.ParenExpr:
+			expr = e.X
+		case *ast.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// A rule is a ctags-style regular expression. The first submatch is the symbol name.
+type rule struct {
+	re   *regexp.Regexp
+	kind string
+}
+
+func newRule(kind string, expr string) rule {
+	return rule{regexp.MustCompile(expr), kind}
+}
+
+var cRules = []rule{
+	newRule(KindType, `^\s*(?:typedef\s+)?(?:struct|union|enum)\s+(\w+)\s*\{`),
+	newRule(KindClass, `^\s*(?:template\s*<[^>]*>\s*)?class\s+(\w+)[^;]*$`),
+	newRule(KindFunc, `^(?:[\w:*&<>]+\s+)+\**(\w+)\s*\([^;]*$`),
+}
+
+var jsRules = []rule{
+	newRule(KindFunc, `^\s*(?:export\s+)?(?:default\s+)?(?:async\s+)?function\s*\*?\s*(\w+)`),
+	newRule(KindClass, `^\s*(?:export\s+)?(?:default\s+)?(?:abstract\s+)?class\s+(\w+)`),
+	newRule(KindFunc, `^\s*(?:export\s+)?(?:var|let|const)\s+(\w+)\s*=\s*(?:async\s+)?(?:function|\([^)]*\)\s*=>)`),
+	newRule(KindType, `^\s*(?:export\s+)?(?:interface|type|enum)\s+(\w+)`),
+}
+
+var rulesByLang = map[string][]rule{
+	lang.C:   cRules,
+	lang.Cpp: cRules,
+	lang.Python: {
+		newRule(KindFunc, `^\s*(?:async\s+)?def\s+(\w+)`),
+		newRule(KindClass, `^\s*class\s+(\w+)`),
+	},
+	lang.Java: {
+		newRule(KindClass, `^\s*(?:(?:public|protected|private|abstract|static|final)\s+)*(?:class|interface|enum|@interface)\s+(\w+)`),
+		newRule(KindMethod, `^\s*(?:(?:public|protected|private|abstract|static|final|synchronized|native)\s+)+[\w<>\[\],.? ]+\s+(\w+)\s*\(`),
+	},
+	lang.Scala: {
+		newRule(KindClass, `^\s*(?:(?:abstract|case|final|sealed|private|protected)\s+)*(?:class|trait|object)\s+(\w+)`),
+		newRule(KindFunc, `^\s*(?:(?:override|private|protected|final)\s+)*def\s+(\w+)`),
+	},
+	lang.JavaScript: jsRules,
+	lang.TypeScript: jsRules,
+	lang.Ruby: {
+		newRule(KindFunc, `^\s*def\s+(?:self\.)?(\w+[?!]?)`),
+		newRule(KindClass, `^\s*(?:class|module)\s+(\w+)`),
+	},
+	lang.Rust: {
+		newRule(KindFunc, `^\s*(?:pub(?:\([^)]*\))?\s+)?(?:const\s+)?(?:async\s+)?(?:unsafe\s+)?fn\s+(\w+)`),
+		newRule(KindType, `^\s*(?:pub(?:\([^)]*\))?\s+)?(?:struct|enum|trait|union|type)\s+(\w+)`),
+	},
+	lang.Shell: {
+		newRule(KindFunc, `^\s*(?:function\s+)?(\w+)\s*\(\)`),
+	},
+	lang.Proto: {
+		newRule(KindType, `^\s*(?:message|enum|service)\s+(\w+)`),
+	},
+	lang.Thrift: {
+		newRule(KindType, `^\s*(?:struct|union|exception|enum|service)\s+(\w+)`),
+	},
+}
+
+var controlKeywords = map[string]struct{}{
+	"if": {}, "for": {}, "while": {}, "switch": {}, "return": {}, "else": {}, "catch": {}, "new": {},
+}
+
+func extractRules(filepath string, fileLang string, data []byte, rules []rule) []*Symbol {
+	var symbols []*Symbol
+	for i, line := range strings.Split(string(data), "\n") {
+		for _, r := range rules {
+			m := r.re.FindStringSubmatchIndex(line)
+			if m == nil {
+				continue
+			}
+			name := line[m[2]:m[3]]
+			if _, isKeyword := controlKeywords[name]; isKeyword {
+				continue
+			}
+			symbols = append(symbols, &Symbol{name, r.kind, "", fileLang, filepath, i + 1, line, m[2]})
+			// first rule wins
+			break
+		}
+	}
+	return symbols
+}
+
+// Table is a searchable set of symbols.
+type Table struct {
+	symbols []*Symbol
+	byName  map[string][]*Symbol
+	matcher grep.IndexedMatcher
+}
+
+func NewTable(symbols []*Symbol) *Table {
+	table := &Table{symbols: symbols, byName: map[string][]*Symbol{}}
+	for _, s := range symbols {
+		name := s.QualifiedName()
+		if _, exists := table.byName[name]; !exists {
+			table.matcher.Add(name)
+		}
+		table.byName[name] = append(table.byName[name], s)
+	}
+	return table
+}
+
+func (t *Table) Len() int {
+	return len(t.symbols)
+}
+
+// Match returns up to limit symbols whose qualified names fuzzy match query, best matches
+// first. If limit <= 0, it returns all matches.
+func (t *Table) Match(query string, limit int) []*Symbol {
+	var out []*Symbol
+	for _, name := range t.matcher.Match(query, limit) {
+		for _, s := range t.byName[name] {
+			if limit > 0 && len(out) == limit {
+				return out
+			}
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Write stores the table in the file at path.
+func (t *Table) Write(path string) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(t.symbols)
+	if err != nil {
+		return err
+	}
+	// a table being read is never partially written
+	return atomicfile.WriteFile(path, buf.Bytes())
+}
+
+// ReadTable reads a table written by Table.Write.
+func ReadTable(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var symbols []*Symbol
+	err = gob.NewDecoder(f).Decode(&symbols)
+	if err != nil {
+		return nil, err
+	}
+	return NewTable(symbols), nil
+}
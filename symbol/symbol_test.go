@@ -0,0 +1,137 @@
+package symbol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/evanj/csearch/lang"
+)
+
+const goSource = `package example
+
+type Matcher struct{}
+
+type (
+	Result int
+	List[T any] []T
+)
+
+func New() *Matcher {
+	return nil
+}
+
+func (m *Matcher) Match(q string) bool {
+	return false
+}
+
+func (l List[T]) Len() int { return len(l) }
+`
+
+func names(symbols []*Symbol) []string {
+	out := []string{}
+	for _, s := range symbols {
+		out = append(out, s.Kind+" "+s.QualifiedName())
+	}
+	return out
+}
+
+func TestExtractGo(t *testing.T) {
+	symbols := Extract("dir/example.go", lang.Go, []byte(goSource))
+	expected := []string{
+		"type Matcher",
+		"type Result",
+		"type List",
+		"func New",
+		"method Matcher.Match",
+		"method List.Len",
+	}
+	if !reflect.DeepEqual(expected, names(symbols)) {
+		t.Error("unexpected symbols", expected, names(symbols))
+	}
+
+	match := symbols[4]
+	if match.LineNumber != 14 || match.Path != "dir/example.go" {
+		t.Error("bad location", *match)
+	}
+	// not the Match in Matcher
+	m := match.ToMatch()
+	if m.Start != len("func (m *Matcher) ") || m.Line[m.Start:m.End] != "Match" {
+		t.Error("bad match", *m)
+	}
+
+	if Extract("bad.go", lang.Go, []byte("package }")) != nil {
+		t.Error("expected no symbols for invalid Go")
+	}
+
+	// line directives do not change the line numbers
+	symbols = Extract("line.go", lang.Go, []byte("package p\n\n//line other.go:1000000\nfunc F() {}\n"))
+	if len(symbols) != 1 || symbols[0].LineNumber != 4 || symbols[0].Line != "func F() {}" {
+		t.Error("bad symbols with a line directive", symbols)
+	}
+}
+
+func TestExtractRules(t *testing.T) {
+	python := "class Foo(object):\n    def bar(self):\n        if x:\n            pass\n\ndef baz():\n    pass\n"
+	expected := []string{"class Foo", "func bar", "func baz"}
+	if output := names(Extract("a.py", lang.Python, []byte(python))); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected python symbols", expected, output)
+	}
+
+	c := "struct point {\n\tint x;\n};\nstatic int add(int a, int b) {\n\tif (a) {\n\t\treturn add(a, b);\n\t}\n}\nint decl(int a);\n"
+	expected = []string{"type point", "func add"}
+	if output := names(Extract("a.c", lang.C, []byte(c))); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected C symbols", expected, output)
+	}
+
+	java := "public class Foo {\n  private static int count(String s) {\n    return helper(s);\n  }\n}\n"
+	expected = []string{"class Foo", "method count"}
+	if output := names(Extract("Foo.java", lang.Java, []byte(java))); !reflect.DeepEqual(expected, output) {
+		t.Error("unexpected Java symbols", expected, output)
+	}
+
+	if Extract("README", "", []byte("def foo():")) != nil {
+		t.Error("expected no symbols for unknown languages")
+	}
+}
+
+func TestTable(t *testing.T) {
+	symbols := []*Symbol{
+		{"Match", KindMethod, "IndexedMatcher", lang.Go, "grep/fuzzy.go", 1, "", 0},
+		{"Match", KindMethod, "FuzzyMatcher", lang.Go, "grep/fuzzy.go", 2, "", 0},
+		{"Match", KindType, "", lang.Go, "grep/grep.go", 3, "", 0},
+		{"Search", KindFunc, "", lang.Go, "reindex/search.go", 4, "", 0},
+	}
+	table := NewTable(symbols)
+
+	results := table.Match("match", 0)
+	if len(results) != 3 || results[0] != symbols[2] {
+		t.Error("expected exact name match first", names(results))
+	}
+	if results := table.Match("match", 2); len(results) != 2 {
+		t.Error("limit not applied", names(results))
+	}
+	if results := table.Match("fuzzymatch", 0); len(results) != 1 || results[0] != symbols[1] {
+		t.Error("expected qualified name match", names(results))
+	}
+
+	tempDir, err := ioutil.TempDir("", "symbol_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	path := filepath.Join(tempDir, "symbols")
+	err = table.Write(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names(symbols), names(read.symbols)) {
+		t.Error("round trip failed", names(read.symbols))
+	}
+}